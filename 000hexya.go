@@ -18,6 +18,7 @@ func init() {
 		Name:    MODULE_NAME,
 		PreInit: func() {},
 		PostInit: func() {
+			initGuestSecret()
 			controllers.Dispatcher.Start()
 		},
 	})
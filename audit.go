@@ -0,0 +1,134 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"encoding/json"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/hexya-addons/bus/bustypes"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/fields"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
+)
+
+const (
+	// auditEnabledParam is the ConfigParameter key that enables the audit of client sent messages
+	auditEnabledParam = "bus.audit_enabled"
+	// auditRetentionParam is the ConfigParameter key of the number of days audit entries are kept
+	auditRetentionParam = "bus.audit_retention_days"
+	// defaultAuditRetentionDays is the number of days audit entries are kept if not configured
+	defaultAuditRetentionDays = 90
+	// auditMessageMaxSize is the maximum number of bytes of a message that are stored in the audit log
+	auditMessageMaxSize = 64 << 10
+)
+
+/* Bus Audit
+Keeps track of the messages that clients send on the bus through the '/longpolling/send'
+endpoint. Entries are only recorded when the audit is enabled in the settings, and
+are garbage collected after the configured retention period.
+*/
+
+var fields_BusAudit = map[string]models.FieldDefinition{
+	"User": fields.Many2One{
+		RelationModel: h.User(),
+		String:        "Sender",
+		Index:         true,
+		ReadOnly:      true},
+
+	"Channel": fields.Char{
+		Index:    true,
+		ReadOnly: true},
+
+	"Message": fields.Text{
+		ReadOnly: true,
+		Help:     "JSON encoded message, truncated if too long"},
+
+	"MessageType": fields.Char{
+		ReadOnly: true},
+
+	"CorrelationID": fields.Char{
+		String:   "Correlation ID",
+		Index:    true,
+		ReadOnly: true},
+
+	"State": fields.Selection{
+		Selection: types.Selection{
+			"sent":     "Sent",
+			"rejected": "Rejected",
+		},
+		Required: true,
+		Index:    true,
+		ReadOnly: true,
+		Default:  models.DefaultValue("sent")},
+
+	"Error": fields.Text{
+		String:   "Rejection Reason",
+		ReadOnly: true},
+}
+
+// IsEnabled returns true if the audit of client sent messages is enabled
+func busAudit_IsEnabled(rs m.BusAuditSet) bool {
+	enabled, _ := strconv.ParseBool(h.ConfigParameter().NewSet(rs.Env()).Sudo().GetParam(auditEnabledParam, "false"))
+	return enabled
+}
+
+// truncateMessage returns the given JSON encoded message as a string of at most maxSize
+// bytes followed by an ellipsis if it is longer. It is cut at a rune boundary so that
+// the result is valid UTF-8.
+func truncateMessage(msgData []byte, maxSize int) string {
+	if len(msgData) <= maxSize {
+		return string(msgData)
+	}
+	end := maxSize
+	for end > 0 && !utf8.RuneStart(msgData[end]) {
+		end--
+	}
+	return string(msgData[:end]) + "..."
+}
+
+// Log records the given client sent notification in the audit log if the audit is enabled.
+// sendErr is the error returned when sending the notification, if any.
+func busAudit_Log(rs m.BusAuditSet, notification *bustypes.Notification, sendErr error) {
+	if !rs.IsEnabled() {
+		return
+	}
+	msgData, err := json.Marshal(notification.Message)
+	if err != nil {
+		msgData = []byte(err.Error())
+	}
+	values := h.BusAudit().NewData().
+		SetUser(h.User().Browse(rs.Env(), []int64{notification.SenderID})).
+		SetChannel(notification.Channel).
+		SetMessage(truncateMessage(msgData, auditMessageMaxSize)).
+		SetMessageType(notification.MessageType).
+		SetCorrelationID(notification.CorrelationID)
+	if sendErr != nil {
+		values.SetState("rejected").SetError(sendErr.Error())
+	}
+	h.BusAudit().NewSet(rs.Env()).Sudo().Create(values)
+}
+
+// Gc removes the audit entries that are older than the configured retention period.
+func busAudit_Gc(rs m.BusAuditSet) int64 {
+	days, err := strconv.Atoi(h.ConfigParameter().NewSet(rs.Env()).Sudo().GetParam(auditRetentionParam, ""))
+	if err != nil || days <= 0 {
+		days = defaultAuditRetentionDays
+	}
+	limit := dates.Now().AddDate(0, 0, -days)
+	return h.BusAudit().NewSet(rs.Env()).Sudo().Search(q.BusAudit().CreateDate().Lower(limit)).Unlink()
+}
+
+func init() {
+	models.NewModel("BusAudit")
+	h.BusAudit().AddFields(fields_BusAudit)
+	h.BusAudit().NewMethod("IsEnabled", busAudit_IsEnabled)
+	h.BusAudit().NewMethod("Log", busAudit_Log)
+	h.BusAudit().NewMethod("Gc", busAudit_Gc)
+}
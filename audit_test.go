@@ -0,0 +1,55 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"testing"
+
+	"github.com/hexya-addons/bus/bustypes"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/q"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAudit(t *testing.T) {
+	Convey("Testing the audit of client sent messages", t, func() {
+		models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			audit := h.BusAudit().NewSet(env)
+			audit.Log(&bustypes.Notification{
+				Channel:  "audited",
+				Message:  "Not audited",
+				SenderID: security.SuperUserID,
+			}, nil)
+			h.ConfigParameter().NewSet(env).SetParam(auditEnabledParam, "true")
+			audit.Log(&bustypes.Notification{
+				Channel:       "audited",
+				Message:       "Audited",
+				CorrelationID: "audit-1",
+				SenderID:      security.SuperUserID,
+			}, nil)
+			audit.Log(&bustypes.Notification{
+				Channel:  "restricted.audited",
+				Message:  "Rejected",
+				SenderID: security.SuperUserID,
+			}, ErrMessageTooLarge)
+			entries := h.BusAudit().Search(env, q.BusAudit().Channel().In([]string{"audited", "restricted.audited"})).
+				OrderBy("ID")
+			So(entries.Len(), ShouldEqual, 2)
+			records := entries.Records()
+			So(records[0].Message(), ShouldEqual, `"Audited"`)
+			So(records[0].CorrelationID(), ShouldEqual, "audit-1")
+			So(records[0].User().ID(), ShouldEqual, security.SuperUserID)
+			So(records[0].State(), ShouldEqual, "sent")
+			So(records[1].State(), ShouldEqual, "rejected")
+			So(records[1].Error(), ShouldEqual, ErrMessageTooLarge.Error())
+		})
+		Convey("Long messages are cut at a rune boundary", func() {
+			So(truncateMessage([]byte(`"été"`), 10), ShouldEqual, `"été"`)
+			So(truncateMessage([]byte(`"été"`), 2), ShouldEqual, `"...`)
+			So(truncateMessage([]byte(`"été"`), 3), ShouldEqual, `"é...`)
+		})
+	})
+}
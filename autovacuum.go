@@ -8,6 +8,12 @@ import (
 // PowerOn executes a vacuum of internal resources.
 func autoVacuum_PowerOn(rs m.AutoVacuumSet) {
 	h.BusBus().NewSet(rs.Env()).Gc()
+	h.BusAudit().NewSet(rs.Env()).Gc()
+	h.BusPresence().NewSet(rs.Env()).Gc()
+	h.BusGuest().NewSet(rs.Env()).Gc()
+	h.BusDigest().NewSet(rs.Env()).Gc()
+	h.BusPresenceHistory().NewSet(rs.Env()).Gc()
+	h.BusUserNotification().NewSet(rs.Env()).Gc()
 	rs.Super().PowerOn()
 }
 
@@ -25,32 +25,95 @@ const (
 )
 
 var fields_BusBus = map[string]models.FieldDefinition{
-	"Channel": fields.Char{},
-	"Message": fields.Char{},
+	"Channel":       fields.Char{},
+	"Message":       fields.Char{},
+	"MessageType":   fields.Char{},
+	"Sender":        fields.Many2One{RelationModel: h.User(), OnDelete: models.SetNull},
+	"CorrelationID": fields.Char{String: "Correlation ID", Index: true},
+	"Alert":         fields.Boolean{},
+	"RequireAck":    fields.Boolean{String: "Require Acknowledgement", Index: true},
+	"Durable":       fields.Boolean{Index: true},
 }
 
-// Gc garbage collects expired notifications, that is notifications that are older than 2 timeouts.
+// Gc garbage collects expired notifications, that is notifications that are older than 2 timeouts,
+// or than receiptRetention for notifications that require an acknowledgement, including durable ones.
 func busBus_Gc(rs m.BusBusSet) int64 {
 	timeoutAgo := dates.Now().Add(-2 * defaultTimeout)
-	return h.BusBus().NewSet(rs.Env()).Sudo().Search(q.BusBus().CreateDate().Lower(timeoutAgo)).Unlink()
+	receiptLimit := dates.Now().Add(-receiptRetention)
+	return h.BusBus().NewSet(rs.Env()).Sudo().Search(
+		q.BusBus().CreateDate().Lower(timeoutAgo).And().RequireAck().Equals(false).
+			OrCond(q.BusBus().CreateDate().Lower(receiptLimit))).Unlink()
 }
 
 // Sendmany sends the given notifications on the bus.
+//
+// Errors are logged. Use SendmanyE to get them instead.
 func busBus_Sendmany(rs m.BusBusSet, notifications []*bustypes.Notification) {
-	channels := make(map[string]bool)
+	if err := rs.SendmanyE(notifications); err != nil {
+		log.Warn("Unable to send bus notifications", "error", err)
+	}
+}
+
+// SendmanyE sends the given notifications on the bus.
+//
+// Notifications are first processed by the registered SendMiddleware chain.
+// Each message is then checked against the ChannelRule of its channel and
+// no notification is sent if any of them is rejected. The ID of the sent
+// notifications is set once they are stored.
+//
+// It returns an error if the notifications are rejected or cannot be stored.
+func busBus_SendmanyE(rs m.BusBusSet, notifications []*bustypes.Notification) error {
+	notifications, err := applySendMiddlewares(rs.Env(), notifications)
+	if err != nil {
+		return err
+	}
 	for _, data := range notifications {
-		channels[data.Channel] = true
+		if !data.Durable {
+			continue
+		}
+		if _, ok := userChannelID(data.Channel); !ok {
+			return fmt.Errorf("durable notifications must be sent on a user channel, got '%s'", data.Channel)
+		}
+		// Durable notifications stay in the inbox until acknowledged
+		data.RequireAck = true
+	}
+	channels := make(map[string]bool)
+	messages := make([]string, len(notifications))
+	for i, data := range notifications {
 		msgData, err := json.Marshal(data.Message)
 		if err != nil {
-			panic(fmt.Errorf("message '%#v' is not json serializable. error: %s", data.Message, err))
+			return fmt.Errorf("message '%#v' is not json serializable. error: %s", data.Message, err)
 		}
-
-		models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		if err := validateMessage(data.Channel, msgData); err != nil {
+			return err
+		}
+		messages[i] = string(msgData)
+	}
+	var createErr error
+	for i, data := range notifications {
+		senderID := data.SenderID
+		if senderID == 0 {
+			senderID = rs.Env().Uid()
+		}
+		createErr = models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
 			// We execute in a new transaction that will be committed before we notify
-			h.BusBus().Create(env, h.BusBus().NewData().
+			notif := h.BusBus().Create(env, h.BusBus().NewData().
 				SetChannel(data.Channel).
-				SetMessage(string(msgData)))
+				SetMessage(messages[i]).
+				SetMessageType(data.MessageType).
+				SetSender(h.User().Browse(env, []int64{senderID})).
+				SetCorrelationID(data.CorrelationID).
+				SetAlert(data.Alert).
+				SetRequireAck(data.RequireAck).
+				SetDurable(data.Durable))
+			data.ID = notif.ID()
 		})
+		if createErr != nil {
+			// We still notify the channels of the notifications already committed
+			createErr = fmt.Errorf("unable to store notification on channel '%s': %s", data.Channel, createErr)
+			break
+		}
+		channels[data.Channel] = true
 	}
 	if len(channels) > 0 {
 		topics := make([]string, len(channels))
@@ -61,24 +124,43 @@ func busBus_Sendmany(rs m.BusBusSet, notifications []*bustypes.Notification) {
 		}
 		topicsJSON, err := json.Marshal(topics)
 		if err != nil {
-			panic(err)
+			return fmt.Errorf("unable to marshal topics %v: %s", topics, err)
 		}
 		query := fmt.Sprintf("NOTIFY imbus, '%s'", topicsJSON)
 		rs.Env().Cr().Execute(query)
 	}
+	return createErr
 }
 
 // Sendone sends a single message on the given channel.
 //
-// message must be json serializable
+// message must be json serializable. Errors are logged. Use SendoneE to get them instead.
 func busBus_Sendone(rs m.BusBusSet, channel string, message interface{}) {
-	rs.Sendmany([]*bustypes.Notification{{
+	if err := rs.SendoneE(channel, message); err != nil {
+		log.Warn("Unable to send bus notification", "channel", channel, "error", err)
+	}
+}
+
+// SendoneE sends a single message on the given channel.
+//
+// message must be json serializable. It returns an error if the message is rejected
+// or cannot be stored.
+func busBus_SendoneE(rs m.BusBusSet, channel string, message interface{}) error {
+	return rs.SendmanyE([]*bustypes.Notification{{
 		Channel: channel,
 		Message: message,
 	}})
 }
 
-// Poll returns pending notifications on the given channels
+// Poll returns pending notifications on the given channels.
+//
+// Partners' status is not part of the result: its changes are published on each partner's PresenceChannel.
+//
+// Notifications whose message cannot be decoded are logged and skipped.
+//
+// If force_status is true, the status of the partners given in the deprecated
+// 'bus_presence_partner_ids' option, as seen by the current user, is appended as
+// 'bus.presence' notifications.
 func busBus_Poll(rs m.BusBusSet, channels []string, last int64, options *types.Context, force_status bool) []*bustypes.Notification {
 	cond := q.BusBus().ID().Greater(last)
 	if last == 0 {
@@ -87,36 +169,41 @@ func busBus_Poll(rs m.BusBusSet, channels []string, last int64, options *types.C
 		cond = q.BusBus().CreateDate().Greater(timeoutAgo)
 	}
 	cond = cond.And().Channel().In(channels)
-	notifications := rs.Sudo().Search(cond).Load(q.BusBus().ID(), q.BusBus().Channel(), q.BusBus().Message())
+	res := toNotifications(rs.Sudo().Search(cond))
+	if force_status {
+		res = append(res, partnersPresenceNotifications(rs.Env(), options)...)
+	}
+	return res
+}
+
+// toNotifications returns the Notification of each of the given records.
+//
+// Records whose message cannot be decoded are logged and skipped.
+func toNotifications(records m.BusBusSet) []*bustypes.Notification {
+	records = records.Load(q.BusBus().ID(), q.BusBus().Channel(), q.BusBus().Message(), q.BusBus().MessageType(),
+		q.BusBus().Sender(), q.BusBus().CorrelationID(), q.BusBus().Alert(), q.BusBus().RequireAck(),
+		q.BusBus().Durable(), q.BusBus().CreateDate())
 	var res []*bustypes.Notification
-	for _, notif := range notifications.Records() {
+	for _, notif := range records.Records() {
 		var message interface{}
 		err := json.Unmarshal([]byte(notif.Message()), &message)
 		if err != nil {
-			panic(fmt.Errorf("unable to JSON unmarshal message '%s'. err: %s", notif.Message(), err))
+			log.Warn("Skipping corrupted bus notification", "id", notif.ID(), "channel", notif.Channel(), "error", err)
+			continue
 		}
 		res = append(res, &bustypes.Notification{
-			ID:      notif.ID(),
-			Channel: notif.Channel(),
-			Message: message,
+			ID:            notif.ID(),
+			Channel:       notif.Channel(),
+			Message:       message,
+			MessageType:   notif.MessageType(),
+			SenderID:      notif.Sender().ID(),
+			CorrelationID: notif.CorrelationID(),
+			Alert:         notif.Alert(),
+			RequireAck:    notif.RequireAck(),
+			Durable:       notif.Durable(),
+			CreateDate:    notif.CreateDate(),
 		})
 	}
-	if len(res) > 0 || force_status {
-		partner_ids := options.GetIntegerSlice("bus_presence_partner_ids")
-		if len(partner_ids) > 0 {
-			for _, p := range h.Partner().Browse(rs.Env(), partner_ids).Records() {
-
-				res = append(res, &bustypes.Notification{
-					ID:      -1,
-					Channel: "bus.presence",
-					Message: map[string]interface{}{
-						"id":        p.ID(),
-						"im_status": p.IMStatus(),
-					},
-				})
-			}
-		}
-	}
 	return res
 }
 
@@ -170,37 +257,122 @@ func (bd *busDispatcher) removeChannel(topic string, ch chan bool) {
 	delete(bd.topics[topic], ch)
 }
 
-// Poll returns the pending notification on the given channels since the last retrieved id.
+// Poll returns the pending notification on the given channels since the last retrieved id,
+// polling as the superuser.
+//
+// Errors are logged. Use PollE to poll for a given user and get them instead.
 func (bd *busDispatcher) Poll(channels []string, last int64, options *types.Context) []*bustypes.Notification {
-	var notifications []*bustypes.Notification
-	models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
-		notifications = h.BusBus().NewSet(env).Poll(channels, last, options, false)
-	})
-	if options.GetBool("peek") {
-		return notifications
+	notifications, err := bd.PollE(security.SuperUserID, channels, last, options)
+	if err != nil {
+		log.Warn("Unable to poll bus notifications", "channels", channels, "error", err)
+	}
+	return notifications
+}
+
+// PollE returns the pending notification on the given channels since the last retrieved id
+// for the user with the given uid.
+//
+// Unless the poll is a peek, the connection identified by the 'bus_device_key' option
+// is recorded as a listener of the tracked channels. The notifications whose IDs are
+// given in the 'bus_ack' option are acknowledged as delivered. If the user polls its
+// UserChannel, the pending notifications of its inbox are returned whatever last is,
+// but the poll only returns without waiting if some of them are newer than last, so
+// that clients which do not acknowledge them do not poll in a tight loop.
+//
+// For the clients that still use the deprecated 'bus_presence_partner_ids' option,
+// the status of the given partners is appended as 'bus.presence' notifications.
+//
+// Poll middlewares are applied before deciding whether to wait, so that a poll whose
+// notifications are all dropped by the middlewares waits for the next ones instead of
+// returning an empty result right away.
+//
+// It returns an error if the notifications could not be retrieved from the database.
+func (bd *busDispatcher) PollE(uid int64, channels []string, last int64, options *types.Context) ([]*bustypes.Notification, error) {
+	if !options.GetBool("peek") {
+		if err := trackListeners(uid, channels, options); err != nil {
+			// Listeners are not critical, we still serve the poll
+			log.Warn("Unable to track channel listeners", "uid", uid, "error", err)
+		}
+	}
+	if ids := ackOption(options); len(ids) > 0 {
+		if err := acknowledgeNotifications(uid, ids); err != nil {
+			log.Warn("Unable to acknowledge notifications", "uid", uid, "error", err)
+		}
+	}
+	inbox, err := pollInbox(uid, channels)
+	if err != nil {
+		return nil, err
 	}
 	timeout := defaultTimeout
 	if options.HasKey("timeout") {
 		timeout = time.Duration(options.GetInteger("timeout")) * time.Second
 	}
-	if len(notifications) == 0 {
-		notifyChan := make(chan bool)
-		for _, channel := range channels {
-			bd.addChannel(channel, notifyChan)
+	if hasNewNotifications(inbox, last) || options.GetBool("peek") {
+		// New inbox notifications are returned without waiting
+		timeout = 0
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		notifications, err := bd.poll(channels, last, options, time.Until(deadline))
+		if err != nil {
+			return nil, err
 		}
-		select {
-		case <-notifyChan:
-			models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
-				notifications = h.BusBus().NewSet(env).Poll(channels, last, options, true)
+		scanned := len(notifications)
+		for _, notif := range notifications {
+			if notif.ID > last {
+				last = notif.ID
+			}
+		}
+		notifications = mergeInbox(inbox, notifications)
+		inbox = nil
+		if hasPollMiddlewares() && len(notifications) > 0 {
+			err = models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+				notifications = applyPollMiddlewares(env, notifications)
 			})
-		case <-time.After(timeout):
+			if err != nil {
+				return nil, err
+			}
 		}
-		// gc channels
-		for _, channel := range channels {
-			bd.removeChannel(channel, notifyChan)
+		if len(notifications) > 0 || scanned == 0 || !time.Now().Before(deadline) {
+			presences, err := legacyPresenceNotifications(uid, options)
+			if err != nil {
+				return nil, err
+			}
+			return append(notifications, presences...), nil
 		}
+		// All the notifications have been dropped by the middlewares, we wait for the next ones
 	}
-	return notifications
+}
+
+// poll returns the pending notification on the given channels since the last retrieved id,
+// waiting at most timeout for new notifications if there are none.
+func (bd *busDispatcher) poll(channels []string, last int64, options *types.Context, timeout time.Duration) ([]*bustypes.Notification, error) {
+	var notifications []*bustypes.Notification
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		notifications = h.BusBus().NewSet(env).Poll(channels, last, options, false)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(notifications) > 0 || timeout <= 0 {
+		return notifications, nil
+	}
+	notifyChan := make(chan bool)
+	for _, channel := range channels {
+		bd.addChannel(channel, notifyChan)
+	}
+	select {
+	case <-notifyChan:
+		err = models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			notifications = h.BusBus().NewSet(env).Poll(channels, last, options, false)
+		})
+	case <-time.After(timeout):
+	}
+	// gc channels
+	for _, channel := range channels {
+		bd.removeChannel(channel, notifyChan)
+	}
+	return notifications, err
 }
 
 // loop dispatches DB notifications to the relevant polling goroutine
@@ -278,8 +450,11 @@ func init() {
 	h.BusBus().AddFields(fields_BusBus)
 	h.BusBus().NewMethod("Gc", busBus_Gc)
 	h.BusBus().NewMethod("Sendmany", busBus_Sendmany)
+	h.BusBus().NewMethod("SendmanyE", busBus_SendmanyE)
 	h.BusBus().NewMethod("Sendone", busBus_Sendone)
+	h.BusBus().NewMethod("SendoneE", busBus_SendoneE)
 	h.BusBus().NewMethod("Poll", busBus_Poll)
 
 	controllers.Dispatcher = newBusDispatcher()
+	controllers.FirePresenceChanges = firePresenceChanges
 }
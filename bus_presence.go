@@ -1,10 +1,14 @@
 package bus
 
 import (
+	"fmt"
+	"sync"
 	"time"
 
+	"github.com/hexya-addons/bus/bustypes"
 	"github.com/hexya-erp/hexya/src/models"
 	"github.com/hexya-erp/hexya/src/models/fields"
+	"github.com/hexya-erp/hexya/src/models/security"
 	"github.com/hexya-erp/hexya/src/models/types"
 	"github.com/hexya-erp/hexya/src/models/types/dates"
 	"github.com/hexya-erp/pool/h"
@@ -12,31 +16,67 @@ import (
 	"github.com/hexya-erp/pool/q"
 )
 
-const awayTimer = 30 * time.Minute
+const (
+	// defaultAwayTimer is the inactivity duration after which users are away if not configured
+	defaultAwayTimer = 30 * time.Minute
+	// presenceSweepPeriod is the period at which timer based status transitions are detected
+	presenceSweepPeriod = 15 * time.Second
+	// presenceFlushPeriod is the period at which buffered presence updates are written
+	presenceFlushPeriod = 5 * time.Second
+	// maxPresenceFlushAttempts is the number of times a presence update is tried before being dropped
+	maxPresenceFlushAttempts = 3
+)
 
-var disconnectionTimer = defaultTimeout + 5*time.Second
+// defaultDisconnectionTimer is the duration without poll after which users are offline if not configured
+var defaultDisconnectionTimer = defaultTimeout + 5*time.Second
 
 /* User Presence
-Its status is 'online', 'away' or 'offline'. This model is not
+Its status is 'online', 'away' or 'offline'. Users can also appear 'busy' or 'dnd'
+depending on their BusPresenceSettings. This model is not
 attached to res_users to avoid database concurrence errors. Since the 'update' method is executed
-at each poll, if the user have multiple opened tabs, concurrence errors can happend, but are 'muted-logged'.
+at each poll, updates are buffered in memory and written once per device every presenceFlushPeriod,
+so that users with multiple opened tabs do not write their presence concurrently.
+
+A user has one presence per device (i.e. per session) and the user's status is the most
+available status of all its devices.
 */
 
+// presenceDeviceRetention is the duration after which the presence of a device that
+// has not polled is removed.
+const presenceDeviceRetention = 30 * 24 * time.Hour
+
 var fields_BusPresence = map[string]models.FieldDefinition{
-	"User": fields.One2One{
+	"User": fields.Many2One{
 		RelationModel: h.User(),
 		String:        "Users",
 		Required:      true,
 		Index:         true,
 		OnDelete:      `cascade`},
 
+	"DeviceKey": fields.Char{
+		String: "Device",
+		Index:  true,
+		Help:   "Identifies the device of the user, typically its session"},
+
+	"DeviceType": fields.Selection{
+		Selection: types.Selection{
+			"desktop": "Desktop",
+			"mobile":  "Mobile",
+			"tablet":  "Tablet",
+			"other":   "Other",
+		},
+		Default: models.DefaultValue("other")},
+
+	"UserAgent": fields.Char{},
+
 	"LastPoll": fields.DateTime{
 		String:  "Last Poll",
-		Default: func(env models.Environment) interface{} { return dates.Now() }},
+		Default: func(env models.Environment) interface{} { return presenceNow() },
+		Help:    "Empty if the user logged out from this device"},
 
 	"LastPresence": fields.DateTime{
 		String:  "Last Presence",
-		Default: func(env models.Environment) interface{} { return dates.Now() }},
+		Default: func(env models.Environment) interface{} { return presenceNow() }},
 
 	"Status": fields.Selection{
 		Selection: types.Selection{
@@ -48,26 +88,433 @@ var fields_BusPresence = map[string]models.FieldDefinition{
 		Default: models.DefaultValue("offline")},
 }
 
-// Update update the last_poll and last_presence of the current user
-func busPresence_Update(rs m.BusPresenceSet, inactivity_period time.Duration) {
-	currentUser := h.User().NewSet(rs.Env()).CurrentUser()
-	presence := h.BusPresence().Search(rs.Env(), q.BusPresence().User().Equals(currentUser))
-	lastPresence := dates.Now().Add(-inactivity_period)
-	values := h.BusPresence().NewData().SetLastPoll(dates.Now())
-	// update the presence or a create a new one
-	if presence.IsEmpty() {
-		values.SetUser(currentUser).SetLastPresence(lastPresence)
-		h.BusPresence().Create(rs.Env(), values)
+// presenceChannelPrefix is the prefix of the partners' presence channels
+const presenceChannelPrefix = "bus.presence."
+
+// PresenceChannel returns the name of the bus channel on which the status
+// changes of the partner with the given ID are published.
+func PresenceChannel(partnerID int64) string {
+	return fmt.Sprintf("%s%d", presenceChannelPrefix, partnerID)
+}
+
+// computeStatus returns the IM status matching the given last poll and last presence dates
+// with the given timers
+func computeStatus(lastPoll, lastPresence dates.DateTime, timers presenceTimers) string {
+	switch {
+	case presenceNow().Sub(lastPoll) > timers.disconnection:
+		return "offline"
+	case presenceNow().Sub(lastPresence) > timers.away:
+		return "away"
+	default:
+		return "online"
+	}
+}
+
+// statusRanks orders the IM statuses, the highest being the most available
+var statusRanks = map[string]int{
+	"offline": 0,
+	"away":    1,
+	"busy":    2,
+	"dnd":     2,
+	"online":  3,
+}
+
+// bestStatus returns the most available of the two given statuses
+func bestStatus(status1, status2 string) string {
+	if statusRanks[status2] > statusRanks[status1] {
+		return status2
+	}
+	return status1
+}
+
+// usersStatuses returns the IM status of the given users, by user ID.
+//
+// Presences are fetched with a single query.
+func usersStatuses(users m.UserSet) map[int64]string {
+	res := usersActivityStatuses(users)
+	for userID, settings := range usersPresenceSettings(users) {
+		res[userID] = applyPresenceSettings(res[userID], settings)
+	}
+	return res
+}
+
+// usersActivityStatuses returns the status of the given users computed from their
+// activity on all their devices only, by user ID.
+func usersActivityStatuses(users m.UserSet) map[int64]string {
+	res := make(map[int64]string)
+	for _, id := range users.Ids() {
+		res[id] = "offline"
+	}
+	if users.IsEmpty() {
+		return res
+	}
+	timers := usersPresenceTimers(users)
+	presences := h.BusPresence().NewSet(users.Env()).Sudo().Search(q.BusPresence().User().In(users)).
+		Load(q.BusPresence().User(), q.BusPresence().LastPoll(), q.BusPresence().LastPresence())
+	for _, presence := range presences.Records() {
+		userID := presence.User().ID()
+		res[userID] = bestStatus(res[userID], computeStatus(presence.LastPoll(), presence.LastPresence(), timers[userID]))
+	}
+	return res
+}
+
+// usersDevices returns the presences of each device of the given users, by user ID.
+func usersDevices(users m.UserSet) map[int64][]bustypes.DevicePresence {
+	res := make(map[int64][]bustypes.DevicePresence)
+	if users.IsEmpty() {
+		return res
+	}
+	timers := usersPresenceTimers(users)
+	presences := h.BusPresence().NewSet(users.Env()).Sudo().Search(q.BusPresence().User().In(users)).
+		OrderBy("LastPoll desc")
+	for _, presence := range presences.Records() {
+		userID := presence.User().ID()
+		res[userID] = append(res[userID], bustypes.DevicePresence{
+			Device: bustypes.Device{
+				Key:        presence.DeviceKey(),
+				DeviceType: presence.DeviceType(),
+				UserAgent:  presence.UserAgent(),
+			},
+			LastPoll:     presence.LastPoll(),
+			LastPresence: presence.LastPresence(),
+			IMStatus:     computeStatus(presence.LastPoll(), presence.LastPresence(), timers[userID]),
+		})
+	}
+	return res
+}
+
+// UpdateStatus updates the stored status of these presences from their last poll
+// and last presence dates, records the changes in the presence history and publishes
+// the changes on the partners' presence channel.
+//
+// It returns the status transitions of the users. The PresenceChangeHandler are not
+// called here: the caller must pass the transitions to firePresenceChanges once its
+// transaction is committed.
+func busPresence_UpdateStatus(rs m.BusPresenceSet) []bustypes.PresenceTransition {
+	partners := h.Partner().NewSet(rs.Env())
+	changed := h.User().NewSet(rs.Env())
+	users := h.User().NewSet(rs.Env())
+	for _, presence := range rs.Records() {
+		users = users.Union(presence.User())
+	}
+	timers := usersPresenceTimers(users)
+	for _, presence := range rs.Records() {
+		status := computeStatus(presence.LastPoll(), presence.LastPresence(), timers[presence.User().ID()])
+		if status == presence.Status() {
+			continue
+		}
+		presence.SetStatus(status)
+		changed = changed.Union(presence.User())
+		partners = partners.Union(presence.User().Partner())
+	}
+	transitions := h.BusPresenceHistory().NewSet(rs.Env()).Record(changed)
+	publishPartnersStatus(partners)
+	return transitions
+}
+
+// publishPartnersStatus publishes the current status of the given partners on their presence channel
+func publishPartnersStatus(partners m.PartnerSet) {
+	if partners.IsEmpty() {
+		return
+	}
+	// The partner's status takes all its users and devices into account
+	statuses := partners.IMStatuses()
+	var notifications []*bustypes.Notification
+	for _, partnerID := range partners.Ids() {
+		notifications = append(notifications, &bustypes.Notification{
+			Channel: PresenceChannel(partnerID),
+			Message: map[string]interface{}{
+				"id":        partnerID,
+				"im_status": statuses[partnerID],
+			},
+		})
+	}
+	if err := h.BusBus().NewSet(partners.Env()).SendmanyE(notifications); err != nil {
+		log.Warn("Unable to publish presence changes", "error", err)
+	}
+}
+
+// legacyPresenceWarning makes sure the use of the 'bus_presence_partner_ids' poll option is only logged once
+var legacyPresenceWarning sync.Once
+
+// legacyPresenceNotifications returns a 'bus.presence' notification with the status
+// of each partner given in the 'bus_presence_partner_ids' poll option, as seen by
+// the user with the given uid.
+//
+// Deprecated: this option is kept for the clients written before the presence channels
+// and will be removed. Clients should listen on the partners' PresenceChannel instead.
+func legacyPresenceNotifications(uid int64, options *types.Context) ([]*bustypes.Notification, error) {
+	if len(options.GetIntegerSlice("bus_presence_partner_ids")) == 0 {
+		return nil, nil
+	}
+	var res []*bustypes.Notification
+	err := models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		res = partnersPresenceNotifications(env, options)
+	})
+	return res, err
+}
+
+// partnersPresenceNotifications returns a 'bus.presence' notification with the status
+// of each partner given in the 'bus_presence_partner_ids' option, as seen by the user
+// of the given environment.
+func partnersPresenceNotifications(env models.Environment, options *types.Context) []*bustypes.Notification {
+	partnerIDs := options.GetIntegerSlice("bus_presence_partner_ids")
+	if len(partnerIDs) == 0 {
+		return nil
+	}
+	legacyPresenceWarning.Do(func() {
+		log.Warn("The 'bus_presence_partner_ids' poll option is deprecated, listen on the partners' presence channels instead")
+	})
+	var res []*bustypes.Notification
+	partners := h.Partner().Browse(env, partnerIDs)
+	statuses := partners.IMStatuses()
+	for _, partnerID := range partners.Ids() {
+		res = append(res, &bustypes.Notification{
+			ID:      -1,
+			Channel: "bus.presence",
+			Message: map[string]interface{}{
+				"id":        partnerID,
+				"im_status": statuses[partnerID],
+			},
+		})
+	}
+	return res
+}
+
+// sweepPresences detects the status transitions of users and guests due to the away and
+// disconnection timers, to the expiry of manual statuses and to do not disturb.
+//
+// The PresenceChangeHandler are called once the transitions are committed.
+func sweepPresences() {
+	var transitions []bustypes.PresenceTransition
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		transitions = h.BusPresence().Search(env, q.BusPresence().Status().NotEquals("offline")).UpdateStatus()
+		h.BusGuest().Search(env, q.BusGuest().Status().NotEquals("offline")).UpdateStatus()
+		h.BusPresenceSettings().NewSet(env).ClearExpiredStatus()
+		h.BusPresenceSettings().NewSet(env).UpdateDND()
+	})
+	if err != nil {
+		log.Warn("Unable to sweep presences", "error", err)
+		return
+	}
+	firePresenceChanges(transitions)
+}
+
+// A presenceKey identifies the presence of a user on a device
+type presenceKey struct {
+	uid    int64
+	device string
+}
+
+// A presenceUpdate is a pending update of a user presence on a device
+type presenceUpdate struct {
+	device       bustypes.Device
+	lastPoll     dates.DateTime
+	lastPresence dates.DateTime
+	// attempts is the number of failed attempts to write this update
+	attempts int
+}
+
+// presenceBuffer coalesces the presence updates of users between two flushes
+type presenceBuffer struct {
+	sync.Mutex
+	updates map[presenceKey]presenceUpdate
+}
+
+// add merges the given update into the pending update of the user with the given uid
+func (pb *presenceBuffer) add(uid int64, update presenceUpdate) {
+	pb.Lock()
+	defer pb.Unlock()
+	key := presenceKey{uid: uid, device: update.device.Key}
+	pending, ok := pb.updates[key]
+	if !ok {
+		pb.updates[key] = update
 		return
 	}
-	if presence.LastPresence().Lower(lastPresence) {
-		values.SetLastPresence(lastPresence)
+	pending.device = update.device
+	if pending.lastPoll.Lower(update.lastPoll) {
+		pending.lastPoll = update.lastPoll
+	}
+	if pending.lastPresence.Lower(update.lastPresence) {
+		pending.lastPresence = update.lastPresence
 	}
-	presence.Write(values)
+	if pending.attempts < update.attempts {
+		pending.attempts = update.attempts
+	}
+	pb.updates[key] = pending
+}
+
+// remove discards the pending update of the user with the given uid on the given device.
+// If device is empty, the pending updates of all the devices of the user are discarded.
+func (pb *presenceBuffer) remove(uid int64, device string) {
+	pb.Lock()
+	defer pb.Unlock()
+	for key := range pb.updates {
+		if key.uid == uid && (device == "" || key.device == device) {
+			delete(pb.updates, key)
+		}
+	}
+}
+
+// pop returns all pending updates and empties the buffer
+func (pb *presenceBuffer) pop() map[presenceKey]presenceUpdate {
+	pb.Lock()
+	defer pb.Unlock()
+	res := pb.updates
+	pb.updates = make(map[presenceKey]presenceUpdate)
+	return res
+}
+
+// pendingPresences holds the presence updates that have not been written yet
+var pendingPresences = &presenceBuffer{
+	updates: make(map[presenceKey]presenceUpdate),
+}
+
+// flushPresences writes the pending presence updates to the database with one write per device.
+//
+// The updates of each user are written in their own transaction, so that an update that
+// cannot be written does not prevent the others from being written. Failed updates are
+// put back in the buffer and dropped after maxPresenceFlushAttempts. The PresenceChangeHandler
+// are called once the updates of the user are committed.
+func flushPresences() {
+	updates := pendingPresences.pop()
+	usersUpdates := make(map[int64]map[presenceKey]presenceUpdate)
+	for key, update := range updates {
+		if usersUpdates[key.uid] == nil {
+			usersUpdates[key.uid] = make(map[presenceKey]presenceUpdate)
+		}
+		usersUpdates[key.uid][key] = update
+	}
+	for uid, userUpdates := range usersUpdates {
+		transitions, err := flushUserPresences(uid, userUpdates)
+		if err == nil {
+			firePresenceChanges(transitions)
+			continue
+		}
+		for key, update := range userUpdates {
+			update.attempts++
+			if update.attempts >= maxPresenceFlushAttempts {
+				log.Warn("Unable to write user presence, dropping update", "uid", uid, "device", key.device,
+					"attempts", update.attempts, "error", err)
+				continue
+			}
+			log.Warn("Unable to write user presence, will retry", "uid", uid, "device", key.device, "error", err)
+			pendingPresences.add(uid, update)
+		}
+	}
+}
+
+// flushUserPresences writes the given pending presence updates of the user with the given uid
+// and returns the resulting status transitions.
+func flushUserPresences(uid int64, updates map[presenceKey]presenceUpdate) ([]bustypes.PresenceTransition, error) {
+	var transitions []bustypes.PresenceTransition
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		user := h.User().BrowseOne(env, uid)
+		presences := h.BusPresence().Search(env, q.BusPresence().User().Equals(user))
+		written := make(map[presenceKey]bool)
+		for _, presence := range presences.Records() {
+			key := presenceKey{uid: uid, device: presence.DeviceKey()}
+			update, ok := updates[key]
+			if !ok {
+				continue
+			}
+			values := h.BusPresence().NewData().
+				SetLastPoll(update.lastPoll).
+				SetUserAgent(update.device.UserAgent)
+			if update.device.DeviceType != "" {
+				values.SetDeviceType(update.device.DeviceType)
+			}
+			if presence.LastPresence().Lower(update.lastPresence) {
+				values.SetLastPresence(update.lastPresence)
+			}
+			presence.Write(values)
+			written[key] = true
+		}
+		for key, update := range updates {
+			if written[key] {
+				continue
+			}
+			values := h.BusPresence().NewData().
+				SetUser(user).
+				SetDeviceKey(update.device.Key).
+				SetUserAgent(update.device.UserAgent).
+				SetLastPoll(update.lastPoll).
+				SetLastPresence(update.lastPresence)
+			if update.device.DeviceType != "" {
+				values.SetDeviceType(update.device.DeviceType)
+			}
+			presences = presences.Union(h.BusPresence().Create(env, values))
+		}
+		transitions = presences.UpdateStatus()
+	})
+	return transitions, err
+}
+
+// Update update the last_poll and last_presence of the current user on the given device.
+//
+// The update is buffered and written to the database by the next presence flush.
+func busPresence_Update(rs m.BusPresenceSet, inactivity_period time.Duration, device bustypes.Device) {
+	pendingPresences.add(rs.Env().Uid(), presenceUpdate{
+		device:       device,
+		lastPoll:     presenceNow(),
+		lastPresence: presenceNow().Add(-inactivity_period),
+	})
+}
+
+// Disconnect marks the current user offline on the device with the given key, typically
+// when the user logs out, without waiting for the disconnection timer. The change is
+// published and the device leaves the tracked channels it was listening on.
+//
+// If deviceKey is empty, the user is disconnected from all its devices.
+//
+// It returns the status transitions of the user, to be passed to the PresenceChangeHandler
+// once the transaction is committed, as with UpdateStatus.
+func busPresence_Disconnect(rs m.BusPresenceSet, deviceKey string) []bustypes.PresenceTransition {
+	uid := rs.Env().Uid()
+	pendingPresences.remove(uid, deviceKey)
+	user := h.User().BrowseOne(rs.Env(), uid)
+	cond := q.BusPresence().User().Equals(user)
+	if deviceKey != "" {
+		cond = cond.And().DeviceKey().Equals(deviceKey)
+	}
+	presences := h.BusPresence().NewSet(rs.Env()).Sudo().Search(cond)
+	// The last presence is kept as the last seen date of the user
+	presences.Write(h.BusPresence().NewData().SetLastPoll(dates.DateTime{}))
+	transitions := presences.UpdateStatus()
+
+	listeners := h.BusChannelListener().NewSet(rs.Env())
+	if deviceKey != "" {
+		listeners.Track(deviceKey, nil, nil)
+		return transitions
+	}
+	devices := make(map[string]bool)
+	for _, listener := range listeners.Sudo().Search(q.BusChannelListener().User().Equals(user)).Records() {
+		devices[listener.DeviceKey()] = true
+	}
+	for device := range devices {
+		listeners.Track(device, nil, nil)
+	}
+	return transitions
+}
+
+// Gc removes the presences of the devices that have not polled for presenceDeviceRetention
+// or from which the user logged out before this period.
+func busPresence_Gc(rs m.BusPresenceSet) int64 {
+	limit := presenceNow().Add(-presenceDeviceRetention)
+	return h.BusPresence().NewSet(rs.Env()).Sudo().Search(
+		q.BusPresence().LastPoll().Lower(limit).
+			OrCond(q.BusPresence().LastPoll().IsNull().And().LastPresence().Lower(limit))).Unlink()
 }
 
 func init() {
 	models.NewModel("BusPresence")
 	h.BusPresence().AddFields(fields_BusPresence)
 	h.BusPresence().NewMethod("Update", busPresence_Update)
+	h.BusPresence().NewMethod("UpdateStatus", busPresence_UpdateStatus)
+	h.BusPresence().NewMethod("Disconnect", busPresence_Disconnect)
+	h.BusPresence().NewMethod("Gc", busPresence_Gc)
+	h.BusPresence().AddSQLConstraint("user_device_uniq", "unique(user_id, device_key)", "A user can only have one presence per device")
+
+	models.RegisterWorker(models.NewWorkerFunction(sweepPresences, presenceSweepPeriod))
+	models.RegisterWorker(models.NewWorkerFunction(flushPresences, presenceFlushPeriod))
 }
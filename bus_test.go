@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/url"
+	"sync"
 	"testing"
 	"time"
 
@@ -16,6 +17,7 @@ import (
 	"github.com/hexya-erp/hexya/src/models"
 	"github.com/hexya-erp/hexya/src/models/security"
 	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
 	"github.com/hexya-erp/hexya/src/server"
 	"github.com/hexya-erp/hexya/src/tests"
 	"github.com/hexya-erp/pool/h"
@@ -26,22 +28,51 @@ func TestMain(m *testing.M) {
 	tests.RunTests(m, "bus", nil)
 }
 
-func TestBus(t *testing.T) {
-	hexyaURL := url.URL{
+// checkEnvelope checks that all notifications of the given poll result have been sent by
+// the user with the given ID less than a minute ago, and returns the result without their
+// sender and creation date, with sorted keys.
+func checkEnvelope(msg json.RawMessage, senderID int64) string {
+	var notifs []map[string]interface{}
+	So(json.Unmarshal(msg, &notifs), ShouldBeNil)
+	for _, notif := range notifs {
+		So(notif["sender_id"], ShouldEqual, senderID)
+		createDate, ok := notif["create_date"].(string)
+		So(ok, ShouldBeTrue)
+		So(dates.ParseDateTime(createDate).Time, ShouldHappenWithin, time.Minute, dates.Now().Time)
+		delete(notif, "sender_id")
+		delete(notif, "create_date")
+	}
+	res, err := json.Marshal(notifs)
+	So(err, ShouldBeNil)
+	return string(res)
+}
+
+var (
+	testServerURL = url.URL{
 		Scheme: "http",
 		Host:   "localhost:8585",
 	}
-	go func() { fmt.Println("server:", server.GetServer().Run(hexyaURL.Host)) }()
-	// Wait for server to come up
-	time.Sleep(500 * time.Millisecond)
-	cl1 := client.NewHexyaClient(hexyaURL.String())
-	cl1.Login("admin", "admin")
-	cl2 := client.NewHexyaClient(hexyaURL.String())
-	cl2.Login("admin", "admin")
-	cl3 := client.NewHexyaClient(hexyaURL.String())
-	cl3.Login("admin", "admin")
-	cl4 := client.NewHexyaClient(hexyaURL.String())
-	cl4.Login("admin", "admin")
+	testServerOnce sync.Once
+)
+
+// newTestClient returns a new client of the test server logged in as admin.
+// The test server is started on the first call.
+func newTestClient() *client.Hexya {
+	testServerOnce.Do(func() {
+		go func() { fmt.Println("server:", server.GetServer().Run(testServerURL.Host)) }()
+		// Wait for server to come up
+		time.Sleep(500 * time.Millisecond)
+	})
+	cl := client.NewHexyaClient(testServerURL.String())
+	cl.Login("admin", "admin")
+	return cl
+}
+
+func TestBus(t *testing.T) {
+	cl1 := newTestClient()
+	cl2 := newTestClient()
+	cl3 := newTestClient()
+	cl4 := newTestClient()
 	Convey("Testing the IM Bus", t, func() {
 		controllers.Dispatcher.Start()
 		Convey("Simple notification to several clients", func() {
@@ -89,8 +120,8 @@ func TestBus(t *testing.T) {
 			err3 := <-errCh3
 			So(err3, ShouldBeNil)
 			msg3 := <-ch3
-			So(string(msg2), ShouldEqual, `[{"id":1,"channel":"channel1","message":{"title":"Hello World!"}}]`)
-			So(string(msg3), ShouldEqual, `[{"id":1,"channel":"channel1","message":{"title":"Hello World!"}}]`)
+			So(checkEnvelope(msg2, security.SuperUserID), ShouldEqual, `[{"channel":"channel1","id":1,"message":{"title":"Hello World!"}}]`)
+			So(checkEnvelope(msg3, security.SuperUserID), ShouldEqual, `[{"channel":"channel1","id":1,"message":{"title":"Hello World!"}}]`)
 			cl1.RPC("/longpolling/send", "call", bustypes.Notification{
 				Channel: "channel2",
 				Message: map[string]interface{}{
@@ -100,7 +131,7 @@ func TestBus(t *testing.T) {
 			err4 := <-errCh4
 			So(err4, ShouldBeNil)
 			msg4 := <-ch4
-			So(string(msg4), ShouldEqual, `[{"id":2,"channel":"channel2","message":{"title":"Hello Everyone!"}}]`)
+			So(checkEnvelope(msg4, security.SuperUserID), ShouldEqual, `[{"channel":"channel2","id":2,"message":{"title":"Hello Everyone!"}}]`)
 		})
 		Convey("Several notifications at once", func() {
 			ch2 := make(chan json.RawMessage)
@@ -135,7 +166,7 @@ func TestBus(t *testing.T) {
 			err2 := <-errCh2
 			So(err2, ShouldBeNil)
 			msg2 := <-ch2
-			So(string(msg2), ShouldEqual, `[{"id":3,"channel":"channel1","message":{"title":"Hello World 2!"}},{"id":4,"channel":"channel1","message":{"title":"Hello World 3!"}}]`)
+			So(checkEnvelope(msg2, security.SuperUserID), ShouldEqual, `[{"channel":"channel1","id":3,"message":{"title":"Hello World 2!"}},{"channel":"channel1","id":4,"message":{"title":"Hello World 3!"}}]`)
 		})
 		Convey("Poll timeout", func() {
 			msg, err := cl2.RPC("/longpolling/poll", "call", bustypes.PollParams{
@@ -151,3 +182,50 @@ func TestBus(t *testing.T) {
 		})
 	})
 }
+
+func TestCorruptedNotifications(t *testing.T) {
+	cl := newTestClient()
+	Convey("Corrupted notifications are skipped", t, func() {
+		models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			h.BusBus().Create(env, h.BusBus().NewData().
+				SetChannel("corrupted").
+				SetMessage("{not json"))
+			err := h.BusBus().NewSet(env).SendoneE("corrupted", "valid")
+			So(err, ShouldBeNil)
+		})
+		msg, err := cl.RPC("/longpolling/poll", "call", bustypes.PollParams{
+			Channels: []string{"corrupted"},
+			Last:     0,
+			Options:  types.NewContext().WithKey("peek", true),
+		})
+		So(err, ShouldBeNil)
+		var notifs []map[string]interface{}
+		So(json.Unmarshal(msg, &notifs), ShouldBeNil)
+		So(notifs, ShouldHaveLength, 1)
+		So(notifs[0]["message"], ShouldEqual, "valid")
+	})
+}
+
+func TestEnvelopeMetadata(t *testing.T) {
+	cl := newTestClient()
+	Convey("Testing the envelope metadata", t, func() {
+		err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			err := h.BusBus().NewSet(env).SendmanyE([]*bustypes.Notification{{
+				Channel:       "metadata",
+				Message:       "Hello",
+				MessageType:   "greeting",
+				CorrelationID: "abc-123",
+			}})
+			So(err, ShouldBeNil)
+		})
+		So(err, ShouldBeNil)
+		msg, err := cl.RPC("/longpolling/poll", "call", bustypes.PollParams{
+			Channels: []string{"metadata"},
+			Last:     0,
+			Options:  types.NewContext().WithKey("peek", true),
+		})
+		So(err, ShouldBeNil)
+		So(checkEnvelope(msg, security.SuperUserID), ShouldEndWith, `"message":"Hello","message_type":"greeting"}]`)
+		So(checkEnvelope(msg, security.SuperUserID), ShouldContainSubstring, `"correlation_id":"abc-123"`)
+	})
+}
@@ -3,7 +3,12 @@
 
 package bustypes
 
-import "github.com/hexya-erp/hexya/src/models/types"
+import (
+	"encoding/json"
+
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+)
 
 // A Notification is a message that is sent/received on a channel over the message bus.
 // Message must be JSON serializable.
@@ -11,6 +16,27 @@ type Notification struct {
 	ID      int64       `json:"id"`
 	Channel string      `json:"channel"`
 	Message interface{} `json:"message"`
+	// MessageType is an optional application defined type of the message
+	MessageType string `json:"message_type,omitempty"`
+	// SenderID is the ID of the user who sent the notification.
+	// It defaults to the user of the sending environment.
+	SenderID int64 `json:"sender_id,omitempty"`
+	// CorrelationID is an optional identifier of the request that caused the notification
+	CorrelationID string `json:"correlation_id,omitempty"`
+	// Alert is true if clients should draw the user's attention to the notification,
+	// e.g. with a popup and a sound. Alerts are deferred to a digest while the
+	// receiving user is in do not disturb.
+	Alert bool `json:"alert,omitempty"`
+	// RequireAck is true if the clients of the recipients must acknowledge the
+	// delivery and the reading of the notification. See BusBus' Acknowledge method.
+	RequireAck bool `json:"require_ack,omitempty"`
+	// Durable is true if the notification is kept in the inbox of the user it is
+	// sent to until acknowledged, so that it reaches offline users. Durable
+	// notifications must be sent on a user channel and always require an acknowledgement.
+	Durable bool `json:"durable,omitempty"`
+	// CreateDate is the date at which the notification has been stored on the bus.
+	// It is set by the bus and ignored when sending.
+	CreateDate dates.DateTime `json:"create_date"`
 }
 
 // PollParams are the parameters of a long poll
@@ -20,9 +46,244 @@ type PollParams struct {
 	Options  *types.Context `json:"options"`
 }
 
-// An IMSearchResult is returned by Partner's IMSearch method
+// A Receipt records the delivery and the reading of a notification by a user
+type Receipt struct {
+	NotificationID int64          `json:"notification_id"`
+	UserID         int64          `json:"user_id"`
+	PartnerID      int64          `json:"partner_id"`
+	DeliveryDate   dates.DateTime `json:"delivery_date"`
+	// ReadDate is nil if the user has not read the notification yet
+	ReadDate *dates.DateTime `json:"read_date,omitempty"`
+}
+
+// AckParams are the parameters of a request to acknowledge notifications
+type AckParams struct {
+	// Delivered are the IDs of the notifications received by the client
+	Delivered []int64 `json:"delivered"`
+	// Read are the IDs of the notifications read by the user
+	Read []int64 `json:"read"`
+}
+
+// ReceiptsParams are the parameters of a request for the receipts of a notification
+type ReceiptsParams struct {
+	NotificationID int64 `json:"notification_id"`
+}
+
+// A UserNotification is a user-facing notification of the notification center
+type UserNotification struct {
+	ID    int64  `json:"id"`
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	// Severity is 'info', 'success', 'warning' or 'danger'
+	Severity string `json:"severity"`
+	// ResModel and ResID identify the record the notification links to, if any
+	ResModel string `json:"res_model,omitempty"`
+	ResID    int64  `json:"res_id,omitempty"`
+	// Action is the ID of the window action the notification links to, if any
+	Action     string         `json:"action,omitempty"`
+	Read       bool           `json:"read"`
+	CreateDate dates.DateTime `json:"create_date"`
+}
+
+// UserNotificationsParams are the parameters of a request for the notifications of the current user
+type UserNotificationsParams struct {
+	UnreadOnly bool `json:"unread_only"`
+	Offset     int  `json:"offset"`
+	// Limit is the maximum number of notifications. Zero means no limit.
+	Limit int `json:"limit"`
+}
+
+// MarkReadParams are the parameters of a request to mark notifications as read
+type MarkReadParams struct {
+	IDs []int64 `json:"ids"`
+}
+
+// A DesktopNotification is a notification shown by the clients of its recipients,
+// as a browser notification if allowed or as a toast otherwise.
+type DesktopNotification struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	// Icon is the URL of the icon of the notification. Clients use their default icon if empty.
+	Icon string `json:"icon,omitempty"`
+	// Sound is true if clients play a sound with the notification
+	Sound bool `json:"sound"`
+	// ClickAction is what clients do when the user clicks the notification, if any
+	ClickAction *ClickAction `json:"click_action,omitempty"`
+}
+
+// A ClickAction opens either a record or a window action
+type ClickAction struct {
+	// ResModel and ResID identify the record to open in a form view
+	ResModel string `json:"res_model,omitempty"`
+	ResID    int64  `json:"res_id,omitempty"`
+	// Action is the ID of the window action to open
+	Action string `json:"action,omitempty"`
+}
+
+// IMSearchParams are the parameters of Partner's SearchIMContacts method
+type IMSearchParams struct {
+	// Name is matched against the name, email and login of users
+	Name   string `json:"name"`
+	Offset int    `json:"offset"`
+	// Limit is the maximum number of results. Zero means no limit.
+	Limit int `json:"limit"`
+	// Statuses restricts the results to the contacts having one of these IM statuses
+	Statuses   []string `json:"statuses"`
+	CompanyIDs []int64  `json:"company_ids"`
+	GroupIDs   []int64  `json:"group_ids"`
+	// IncludePartners includes the partners that have no user in the results
+	IncludePartners bool `json:"include_partners"`
+}
+
+// An IMSearchResult is returned by Partner's SearchIMContacts and IMSearch methods
 type IMSearchResult struct {
-	ID       int64  `json:"id"`
-	Name     string `json:"name"`
-	IMStatus string `json:"im_status"`
+	// ID is the ID of the partner
+	ID int64 `json:"id"`
+	// UserID is the ID of the user, or zero if the partner has no user
+	UserID        int64  `json:"user_id,omitempty"`
+	Name          string `json:"name"`
+	IMStatus      string `json:"im_status"`
+	StatusMessage string `json:"status_message,omitempty"`
+	AvatarURL     string `json:"avatar_url"`
+}
+
+// IMStatusParams are the parameters of an IM status request
+type IMStatusParams struct {
+	PartnerIDs []int64 `json:"partner_ids"`
+	UserIDs    []int64 `json:"user_ids"`
+	GuestIDs   []int64 `json:"guest_ids"`
+}
+
+// An IMStatus is the IM status of a partner or a user
+type IMStatus struct {
+	ID            int64  `json:"id"`
+	IMStatus      string `json:"im_status"`
+	StatusMessage string `json:"status_message,omitempty"`
+	// LastSeen is the last activity date, if the user chose to show it
+	LastSeen *dates.DateTime `json:"last_seen,omitempty"`
+}
+
+// SetStatusParams are the parameters of a request to set the current user's status manually
+type SetStatusParams struct {
+	// Status is the manual status. Empty means computed from the user's activity.
+	Status string `json:"status"`
+	// Message is a free text status message
+	Message string `json:"message"`
+	// Duration is the number of seconds after which the status and message
+	// are cleared. Zero means no expiry.
+	Duration int64 `json:"duration"`
+}
+
+// PresenceTimers are the timers used to compute the status of a user
+type PresenceTimers struct {
+	// AwayTimer is the number of seconds of inactivity after which the user is away
+	AwayTimer int64 `json:"away_timer"`
+	// DisconnectionTimer is the number of seconds without poll after which the user is offline
+	DisconnectionTimer int64 `json:"disconnection_timer"`
+}
+
+// A PresenceInterval is a period during which a user had a given status
+type PresenceInterval struct {
+	UserID int64          `json:"user_id"`
+	Status string         `json:"status"`
+	From   dates.DateTime `json:"from"`
+	To     dates.DateTime `json:"to"`
+}
+
+// A PresenceTransition is a change of the status of a user
+type PresenceTransition struct {
+	UserID    int64  `json:"user_id"`
+	OldStatus string `json:"old_status"`
+	NewStatus string `json:"new_status"`
+}
+
+// PresenceDailyStats are the durations during which a user was online and away on a given day
+type PresenceDailyStats struct {
+	UserID int64      `json:"user_id"`
+	Date   dates.Date `json:"date"`
+	// OnlineDuration is the number of seconds during which the user was online
+	OnlineDuration int64 `json:"online_duration"`
+	// AwayDuration is the number of seconds during which the user was away
+	AwayDuration int64 `json:"away_duration"`
+}
+
+// A ChannelListener is a connection of a user listening on a channel
+type ChannelListener struct {
+	// ID identifies the connection on the channel
+	ID        int64 `json:"id"`
+	UserID    int64 `json:"user_id"`
+	PartnerID int64 `json:"partner_id"`
+	// Metadata is the JSON metadata given by the connection for this channel
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+}
+
+// ListenersParams are the parameters of a request for the listeners of a channel
+type ListenersParams struct {
+	Channel string `json:"channel"`
+}
+
+// PrivacyParams are the parameters of a request to set the presence privacy of the current user
+type PrivacyParams struct {
+	// Visibility is who can see the user's status: 'everyone', 'company' or 'nobody'
+	Visibility     string `json:"visibility"`
+	ShowLastSeen   bool   `json:"show_last_seen"`
+	HideFromPortal bool   `json:"hide_from_portal"`
+}
+
+// SnoozeParams are the parameters of a request to snooze the current user's notifications
+type SnoozeParams struct {
+	// Duration is the number of seconds during which the user is in do not disturb.
+	// Zero cancels the snooze.
+	Duration int64 `json:"duration"`
+}
+
+// An IMStatusResult is the response to an IM status request
+type IMStatusResult struct {
+	Partners []IMStatus `json:"partners"`
+	Users    []IMStatus `json:"users"`
+	Guests   []IMStatus `json:"guests"`
+}
+
+// GuestHeartbeatParams are the parameters of the heartbeat of a guest
+type GuestHeartbeatParams struct {
+	// Token is the signed token of the guest
+	Token string `json:"token"`
+	// Inactivity is the number of milliseconds since the last activity of the guest
+	Inactivity int64 `json:"inactivity"`
+}
+
+// HeartbeatParams are the parameters of a presence heartbeat
+type HeartbeatParams struct {
+	// Inactivity is the number of milliseconds since the last user activity
+	Inactivity int64 `json:"inactivity"`
+	// DeviceType is the type of the client device. It is guessed from the
+	// user agent if empty.
+	DeviceType string `json:"device_type"`
+}
+
+// A Device identifies a client device of a user for presence tracking
+type Device struct {
+	// Key identifies the device among the user's devices, typically its session
+	Key        string `json:"key"`
+	DeviceType string `json:"device_type"`
+	UserAgent  string `json:"user_agent"`
+}
+
+// A DevicePresence is the presence of a user on one of their devices
+type DevicePresence struct {
+	Device
+	LastPoll     dates.DateTime `json:"last_poll"`
+	LastPresence dates.DateTime `json:"last_presence"`
+	IMStatus     string         `json:"im_status"`
+}
+
+// DevicesParams are the parameters of a request for the devices of users
+type DevicesParams struct {
+	UserIDs []int64 `json:"user_ids"`
+}
+
+// UserDevices lists the devices of a user
+type UserDevices struct {
+	UserID  int64            `json:"user_id"`
+	Devices []DevicePresence `json:"devices"`
 }
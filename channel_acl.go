@@ -0,0 +1,103 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hexya-addons/bus/bustypes"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+)
+
+// channelACLPollMiddlewareSequence is the sequence of the poll middleware that drops
+// the notifications of the channels the polling user may not receive, so that it
+// runs before all the other middlewares.
+const channelACLPollMiddlewareSequence = -1000
+
+// reservedMessageTypePrefix is the prefix of the message types of the notifications
+// sent by the bus itself, such as desktop notifications, digests and receipts.
+const reservedMessageTypePrefix = "bus."
+
+/* Channel Access Control
+Clients choose the channels they poll. Most channels are shared and any user may
+poll them, but the per-user channels (the UserChannel and the UnreadCounterChannel)
+carry private data such as digests, receipts and desktop notifications, and may only
+be polled by their user.
+
+Clients send notifications with SendFromClient. They may not send on per-user
+channels, which are written by the server only, nor use the message types reserved
+to the bus, so that they cannot forge desktop notifications for instance. Their
+notifications are never durable nor require an acknowledgement.
+*/
+
+// perUserChannelPrefixes are the prefixes of the channels that are followed by the
+// ID of the only user that may poll them.
+var perUserChannelPrefixes = []string{userChannelPrefix, unreadCounterChannelPrefix}
+
+// mayPollChannel returns true if the user with the given ID may receive the
+// notifications of the given channel.
+func mayPollChannel(uid int64, channel string) bool {
+	for _, prefix := range perUserChannelPrefixes {
+		if strings.HasPrefix(channel, prefix) {
+			return channel == fmt.Sprintf("%s%d", prefix, uid)
+		}
+	}
+	return true
+}
+
+// channelACLPollMiddleware drops the notifications of the per-user channels of
+// other users than the polling one.
+func channelACLPollMiddleware(env models.Environment, notification *bustypes.Notification) []*bustypes.Notification {
+	if !mayPollChannel(env.Uid(), notification.Channel) {
+		return nil
+	}
+	return []*bustypes.Notification{notification}
+}
+
+// reservedMessageType returns the message type reserved to the bus of the given
+// notification, either as its MessageType or as the 'type' key of its message, or
+// an empty string if it has none.
+func reservedMessageType(notification *bustypes.Notification) string {
+	if strings.HasPrefix(notification.MessageType, reservedMessageTypePrefix) {
+		return notification.MessageType
+	}
+	message, ok := notification.Message.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	if msgType, _ := message["type"].(string); strings.HasPrefix(msgType, reservedMessageTypePrefix) {
+		return msgType
+	}
+	return ""
+}
+
+// SendFromClient sends the given notification received from a client of the current user.
+//
+// It returns an error if the notification is sent on a per-user channel or has a message
+// type reserved to the bus. The sender of the notification is set to the current user
+// and its Durable and RequireAck flags are ignored.
+func busBus_SendFromClient(rs m.BusBusSet, notification *bustypes.Notification) error {
+	// Clients cannot impersonate other users
+	notification.SenderID = rs.Env().Uid()
+	notification.Durable = false
+	notification.RequireAck = false
+	for _, prefix := range perUserChannelPrefixes {
+		if strings.HasPrefix(notification.Channel, prefix) {
+			return fmt.Errorf("clients cannot send on channel '%s'", notification.Channel)
+		}
+	}
+	if msgType := reservedMessageType(notification); msgType != "" {
+		return fmt.Errorf("clients cannot send messages of type '%s'", msgType)
+	}
+	return h.BusBus().NewSet(rs.Env()).SendmanyE([]*bustypes.Notification{notification})
+}
+
+func init() {
+	h.BusBus().NewMethod("SendFromClient", busBus_SendFromClient)
+
+	RegisterPollMiddleware(channelACLPollMiddlewareSequence, channelACLPollMiddleware)
+}
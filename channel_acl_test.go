@@ -0,0 +1,74 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"testing"
+
+	"github.com/hexya-addons/bus/bustypes"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/q"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestChannelACL(t *testing.T) {
+	cl := newTestClient()
+	Convey("Testing channels access control", t, func() {
+		const otherID = 987654
+		Convey("Per-user channels can only be polled by their user", func() {
+			So(mayPollChannel(7, UserChannel(7)), ShouldBeTrue)
+			So(mayPollChannel(7, UnreadCounterChannel(7)), ShouldBeTrue)
+			So(mayPollChannel(7, UserChannel(otherID)), ShouldBeFalse)
+			So(mayPollChannel(7, UnreadCounterChannel(otherID)), ShouldBeFalse)
+			So(mayPollChannel(7, UserChannel(7)+"x"), ShouldBeFalse)
+			So(mayPollChannel(7, "channel1"), ShouldBeTrue)
+		})
+		Convey("Notifications of other users' channels are not polled", func() {
+			own := &bustypes.Notification{Channel: UserChannel(security.SuperUserID), Message: "own"}
+			other := &bustypes.Notification{Channel: UserChannel(otherID), Message: "other"}
+			counter := &bustypes.Notification{Channel: UnreadCounterChannel(otherID), Message: 3}
+			models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+				So(h.BusBus().NewSet(env).SendmanyE([]*bustypes.Notification{other, counter, own}), ShouldBeNil)
+			})
+			res, err := newBusDispatcher().PollE(security.SuperUserID,
+				[]string{UserChannel(security.SuperUserID), UserChannel(otherID), UnreadCounterChannel(otherID)},
+				other.ID-1, types.NewContext().WithKey("timeout", 1))
+			So(err, ShouldBeNil)
+			var messages []interface{}
+			for _, notif := range res {
+				So(notif.Channel, ShouldEqual, UserChannel(security.SuperUserID))
+				messages = append(messages, notif.Message)
+			}
+			So(messages, ShouldContain, "own")
+		})
+		Convey("Clients cannot send on per-user channels nor durable notifications", func() {
+			_, err := cl.RPC("/longpolling/send", "call", bustypes.Notification{
+				Channel: UserChannel(security.SuperUserID),
+				Message: "Fake",
+			})
+			So(err, ShouldNotBeNil)
+			_, err = cl.RPC("/longpolling/send", "call", bustypes.Notification{
+				Channel: UnreadCounterChannel(security.SuperUserID),
+				Message: 42,
+			})
+			So(err, ShouldNotBeNil)
+			_, err = cl.RPC("/longpolling/send", "call", bustypes.Notification{
+				Channel:    "client.flags",
+				Message:    "Hello",
+				RequireAck: true,
+				Durable:    true,
+			})
+			So(err, ShouldBeNil)
+			models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+				sent := h.BusBus().Search(env, q.BusBus().Channel().Equals("client.flags"))
+				So(sent.Len(), ShouldEqual, 1)
+				So(sent.RequireAck(), ShouldBeFalse)
+				So(sent.Durable(), ShouldBeFalse)
+			})
+		})
+	})
+}
@@ -0,0 +1,100 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+)
+
+/* Presence Clock
+All presence computations (statuses, timers, do not disturb, history, guests and
+channel listeners) get the current time from the presence clock instead of the
+system time, so that tests can replace it with a FakeClock and advance time
+deterministically.
+*/
+
+// A Clock gives the current time to the presence code
+type Clock interface {
+	// Now returns the current date and time in UTC
+	Now() dates.DateTime
+}
+
+// systemClock is the Clock that returns the system time
+type systemClock struct{}
+
+// Now returns the current system time
+func (systemClock) Now() dates.DateTime {
+	return dates.Now()
+}
+
+// presenceClock is the Clock currently used by the presence code
+var presenceClock = struct {
+	sync.RWMutex
+	clock Clock
+}{
+	clock: systemClock{},
+}
+
+// SetClock replaces the clock used by the presence code and returns the previous one.
+// A nil clock restores the system clock.
+//
+// It is meant for tests and should not be called in production.
+func SetClock(clock Clock) Clock {
+	if clock == nil {
+		clock = systemClock{}
+	}
+	presenceClock.Lock()
+	defer presenceClock.Unlock()
+	previous := presenceClock.clock
+	presenceClock.clock = clock
+	return previous
+}
+
+// presenceNow returns the current time of the presence clock
+func presenceNow() dates.DateTime {
+	presenceClock.RLock()
+	defer presenceClock.RUnlock()
+	return presenceClock.clock.Now()
+}
+
+// presenceToday returns the current day (UTC) of the presence clock
+func presenceToday() dates.Date {
+	now := presenceNow()
+	return dates.Date{Time: time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)}
+}
+
+// A FakeClock is a Clock whose time only changes when it is set or advanced
+type FakeClock struct {
+	sync.Mutex
+	now dates.DateTime
+}
+
+// NewFakeClock returns a FakeClock set at the given time
+func NewFakeClock(now dates.DateTime) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns the current time of the fake clock
+func (fc *FakeClock) Now() dates.DateTime {
+	fc.Lock()
+	defer fc.Unlock()
+	return fc.now
+}
+
+// Set sets the current time of the fake clock
+func (fc *FakeClock) Set(now dates.DateTime) {
+	fc.Lock()
+	defer fc.Unlock()
+	fc.now = now
+}
+
+// Advance moves the fake clock forward by the given duration
+func (fc *FakeClock) Advance(duration time.Duration) {
+	fc.Lock()
+	defer fc.Unlock()
+	fc.now = fc.now.Add(duration)
+}
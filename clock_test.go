@@ -0,0 +1,52 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/q"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPresenceClock(t *testing.T) {
+	Convey("Testing presence with a fake clock", t, func() {
+		clock := NewFakeClock(dates.Now())
+		previous := SetClock(clock)
+		models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			user := h.User().Create(env, h.User().NewData().SetName("Clock User").SetLogin("clock_user"))
+			user.SetPresencePrivacy("everyone", true, false)
+			presence := h.BusPresence().Create(env, h.BusPresence().NewData().
+				SetUser(user).
+				SetLastPoll(clock.Now()).
+				SetLastPresence(clock.Now()))
+			sweep := func() {
+				h.BusPresence().Search(env, q.BusPresence().Status().NotEquals("offline")).UpdateStatus()
+			}
+			presence.UpdateStatus()
+			So(presence.Status(), ShouldEqual, "online")
+			Convey("Stored statuses follow the clock and can be queried", func() {
+				clock.Advance(defaultAwayTimer + time.Minute)
+				awayAt := clock.Now()
+				presence.SetLastPoll(awayAt)
+				sweep()
+				So(presence.Status(), ShouldEqual, "away")
+				So(h.BusPresence().Search(env, q.BusPresence().Status().Equals("away").And().User().Equals(user)).Len(), ShouldEqual, 1)
+				clock.Advance(2 * defaultDisconnectionTimer)
+				sweep()
+				So(presence.Status(), ShouldEqual, "offline")
+				So(user.IMStatus(), ShouldEqual, "offline")
+				So(user.LastOnline().Time, ShouldHappenWithin, time.Millisecond, awayAt.Time)
+			})
+		})
+		Reset(func() {
+			SetClock(previous)
+		})
+	})
+}
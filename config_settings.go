@@ -0,0 +1,70 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"time"
+
+	"github.com/hexya-addons/base/basetypes"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/fields"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+)
+
+var fields_ConfigSettings = map[string]models.FieldDefinition{
+	"BusAuditEnabled": fields.Boolean{
+		String: "Audit Client Messages",
+		Help:   "Record the messages sent by clients on the bus"},
+
+	"BusAuditRetentionDays": fields.Integer{
+		String:  "Audit Retention (days)",
+		Default: models.DefaultValue(defaultAuditRetentionDays)},
+
+	"BusAwayTimer": fields.Integer{
+		String:  "Away Timer (minutes)",
+		Default: models.DefaultValue(int64(defaultAwayTimer / time.Minute)),
+		Help:    "Minutes of inactivity after which users are away, unless set on their company"},
+
+	"BusDisconnectionTimer": fields.Integer{
+		String:     "Disconnection Timer (seconds)",
+		Default:    func(env models.Environment) interface{} { return int64(defaultDisconnectionTimer / time.Second) },
+		Help:       "Seconds without poll after which users are offline, unless set on their company",
+		Constraint: h.ConfigSettings().Methods().CheckBusDisconnectionTimer()},
+
+	"BusPresenceHistoryRetentionDays": fields.Integer{
+		String:  "Presence History Retention (days)",
+		Default: models.DefaultValue(defaultHistoryRetentionDays),
+		Help:    "Presence history entries are removed after this delay. Daily statistics are kept."},
+
+	"BusGuestTokenValidityDays": fields.Integer{
+		String:  "Guest Token Validity (days)",
+		Default: models.DefaultValue(defaultGuestTokenValidityDays),
+		Help:    "Guest tokens expire after this delay and a new one must be issued"},
+}
+
+// ConfigFields maps the bus settings to their ConfigParameter keys
+func configSettings_ConfigFields(rs m.ConfigSettingsSet) basetypes.ConfigFieldsMap {
+	res := rs.Super().ConfigFields()
+	res[h.ConfigSettings().Fields().BusAuditEnabled()] = auditEnabledParam
+	res[h.ConfigSettings().Fields().BusAuditRetentionDays()] = auditRetentionParam
+	res[h.ConfigSettings().Fields().BusAwayTimer()] = awayTimerParam
+	res[h.ConfigSettings().Fields().BusDisconnectionTimer()] = disconnectionTimerParam
+	res[h.ConfigSettings().Fields().BusPresenceHistoryRetentionDays()] = historyRetentionParam
+	res[h.ConfigSettings().Fields().BusGuestTokenValidityDays()] = guestTokenValidityParam
+	return res
+}
+
+// CheckBusDisconnectionTimer checks that the disconnection timer is not too low.
+func configSettings_CheckBusDisconnectionTimer(rs m.ConfigSettingsSet) {
+	for _, settings := range rs.Records() {
+		checkDisconnectionTimer(settings, settings.BusDisconnectionTimer())
+	}
+}
+
+func init() {
+	h.ConfigSettings().AddFields(fields_ConfigSettings)
+	h.ConfigSettings().NewMethod("CheckBusDisconnectionTimer", configSettings_CheckBusDisconnectionTimer)
+	h.ConfigSettings().Methods().ConfigFields().Extend(configSettings_ConfigFields)
+}
@@ -1,28 +1,51 @@
 package controllers
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/hexya-addons/bus/bustypes"
 	web "github.com/hexya-addons/web/controllers"
 	"github.com/hexya-erp/hexya/src/controllers"
 	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
 	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
 	"github.com/hexya-erp/hexya/src/server"
+	"github.com/hexya-erp/hexya/src/tools/exceptions"
 	"github.com/hexya-erp/hexya/src/tools/logging"
 	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/q"
 )
 
+// CorrelationIDHeader is the HTTP header from which the correlation ID of
+// client sent notifications is read when it is not given in the parameters.
+const CorrelationIDHeader = "X-Correlation-ID"
+
+// DeviceKeySessionKey is the session key under which the key that identifies
+// the device of the session for presence and channel listeners is stored.
+const DeviceKeySessionKey = "bus_device_key"
+
 // Dispatcher is the long polling dispatching loop
 var Dispatcher Poller
 
+// FirePresenceChanges calls the presence change handlers for the given status transitions.
+// It must be called once the transitions are committed.
+var FirePresenceChanges func([]bustypes.PresenceTransition)
+
 var log logging.Logger
 
 // A Poller is a long poll dispatching loop
 type Poller interface {
 	// Poll returns the pending notification on the given channels since the last retrieved id.
+	// Errors are logged.
 	Poll([]string, int64, *types.Context) []*bustypes.Notification
+	// PollE returns the pending notification on the given channels since the last retrieved id
+	// for the user with the given uid. It returns an error if the notifications could not be retrieved.
+	PollE(int64, []string, int64, *types.Context) ([]*bustypes.Notification, error)
 	// Stop the dispatching loop
 	Stop()
 	// Start the dispatching loop
@@ -35,9 +58,17 @@ func Send(c *server.Context) {
 	web.CheckUser(uid)
 	var params bustypes.Notification
 	c.BindRPCParams(&params)
+	if params.CorrelationID == "" {
+		params.CorrelationID = c.GetHeader(CorrelationIDHeader)
+	}
+	var sendErr error
 	err := models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
-		h.BusBus().NewSet(env).Sendone(params.Channel, params.Message)
+		sendErr = h.BusBus().NewSet(env).SendFromClient(&params)
+		h.BusAudit().NewSet(env).Log(&params, sendErr)
 	})
+	if sendErr != nil {
+		err = exceptions.UserError{Message: sendErr.Error()}
+	}
 	c.RPC(http.StatusOK, nil, err)
 }
 
@@ -56,18 +87,402 @@ func Poll(c *server.Context) {
 	if params.Options == nil {
 		params.Options = types.NewContext()
 	}
+	device := getDevice(c, params.Options.GetString("bus_device_type"))
+	// Identifies the connection for channel listeners. Clients cannot set it.
+	params.Options = params.Options.WithKey("bus_device_key", device.Key)
 	if params.Options.HasKey("bus_inactivity") {
-		models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
-			h.BusPresence().NewSet(env).Update(time.Duration(params.Options.GetInteger("bus_inactivity")) * time.Millisecond)
+		if err := updatePresence(uid, params.Options.GetInteger("bus_inactivity"), device); err != nil {
+			// Presence is not critical, we still serve the poll
+			log.Warn("Unable to update user presence", "uid", uid, "error", err)
+		}
+	}
+	notifications, err := Dispatcher.PollE(uid, params.Channels, params.Last, params.Options)
+	if err != nil {
+		c.RPC(http.StatusOK, nil, exceptions.UserError{
+			Message: "Unable to retrieve bus notifications",
+			Debug:   err.Error(),
 		})
+		return
 	}
-	notifications := Dispatcher.Poll(params.Channels, params.Last, params.Options)
 	if notifications == nil {
 		notifications = []*bustypes.Notification{}
 	}
 	c.RPC(http.StatusOK, notifications)
 }
 
+// getDevice returns the device of the current session. If deviceType
+// is empty, it is guessed from the user agent.
+func getDevice(c *server.Context, deviceType string) bustypes.Device {
+	userAgent := c.GetHeader("User-Agent")
+	if deviceType == "" {
+		deviceType = deviceTypeFromUserAgent(userAgent)
+	}
+	return bustypes.Device{
+		Key:        sessionDeviceKey(c),
+		DeviceType: deviceType,
+		UserAgent:  userAgent,
+	}
+}
+
+// sessionDeviceKey returns the key that identifies the device of the current session,
+// generating a random one and storing it in the session the first time.
+func sessionDeviceKey(c *server.Context) string {
+	sess := c.Session()
+	if key, ok := sess.Get(DeviceKeySessionKey).(string); ok && key != "" {
+		return key
+	}
+	data := make([]byte, 16)
+	if _, err := rand.Read(data); err != nil {
+		log.Warn("Unable to generate a device key", "error", err)
+		return ""
+	}
+	key := hex.EncodeToString(data)
+	sess.Set(DeviceKeySessionKey, key)
+	if err := sess.Save(); err != nil {
+		log.Warn("Unable to save the device key in the session", "error", err)
+	}
+	return key
+}
+
+// deviceTypeFromUserAgent guesses the type of device from the given user agent
+func deviceTypeFromUserAgent(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	switch {
+	case ua == "":
+		return "other"
+	case strings.Contains(ua, "ipad") || strings.Contains(ua, "tablet"):
+		return "tablet"
+	case strings.Contains(ua, "mobile") || strings.Contains(ua, "android") || strings.Contains(ua, "iphone"):
+		return "mobile"
+	default:
+		return "desktop"
+	}
+}
+
+// updatePresence updates the presence of the user with the given uid on the given
+// device, the user having been inactive for the given number of milliseconds.
+func updatePresence(uid int64, inactivity int64, device bustypes.Device) error {
+	return models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		h.BusPresence().NewSet(env).Update(inactivityDuration(inactivity), device)
+	})
+}
+
+// inactivityDuration returns the duration of the given number of milliseconds of
+// inactivity sent by a client. Negative values are taken as zero.
+func inactivityDuration(inactivity int64) time.Duration {
+	if inactivity < 0 {
+		return 0
+	}
+	return time.Duration(inactivity) * time.Millisecond
+}
+
+// Heartbeat updates the presence of the current user without polling.
+//
+// It is meant for clients that do not hold a long poll open.
+func Heartbeat(c *server.Context) {
+	uid := c.Session().Get("uid").(int64)
+	web.CheckUser(uid)
+	var params bustypes.HeartbeatParams
+	c.BindRPCParams(&params)
+	err := updatePresence(uid, params.Inactivity, getDevice(c, params.DeviceType))
+	c.RPC(http.StatusOK, nil, err)
+}
+
+// GuestHeartbeat updates the presence of the guest authenticated by the given token.
+//
+// It does not require a user session so that website visitors and API clients can call it.
+func GuestHeartbeat(c *server.Context) {
+	var params bustypes.GuestHeartbeatParams
+	c.BindRPCParams(&params)
+	var valid bool
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		guest := h.BusGuest().NewSet(env).FromToken(params.Token)
+		if guest.IsEmpty() {
+			return
+		}
+		valid = true
+		guest.Heartbeat(inactivityDuration(params.Inactivity))
+	})
+	if err == nil && !valid {
+		err = exceptions.UserError{Message: "Invalid guest token"}
+	}
+	c.RPC(http.StatusOK, nil, err)
+}
+
+// Ack acknowledges the delivery and the reading of notifications by the current user
+func Ack(c *server.Context) {
+	uid := c.Session().Get("uid").(int64)
+	web.CheckUser(uid)
+	var params bustypes.AckParams
+	c.BindRPCParams(&params)
+	err := models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		h.BusBus().Browse(env, params.Delivered).Acknowledge(false)
+		h.BusBus().Browse(env, params.Read).Acknowledge(true)
+	})
+	c.RPC(http.StatusOK, nil, err)
+}
+
+// InboxCount returns the number of durable notifications that the current user has not acknowledged yet
+func InboxCount(c *server.Context) {
+	uid := c.Session().Get("uid").(int64)
+	web.CheckUser(uid)
+	var res int64
+	err := models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		res = h.User().NewSet(env).CurrentUser().InboxCounts()[uid]
+	})
+	c.RPC(http.StatusOK, res, err)
+}
+
+// Notifications returns the notification center notifications of the current user
+func Notifications(c *server.Context) {
+	uid := c.Session().Get("uid").(int64)
+	web.CheckUser(uid)
+	var params bustypes.UserNotificationsParams
+	c.BindRPCParams(&params)
+	var res []bustypes.UserNotification
+	err := models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		res = h.User().NewSet(env).CurrentUser().Notifications(params)
+	})
+	c.RPC(http.StatusOK, res, err)
+}
+
+// MarkNotificationsRead marks the given notifications of the current user as read
+func MarkNotificationsRead(c *server.Context) {
+	uid := c.Session().Get("uid").(int64)
+	web.CheckUser(uid)
+	var params bustypes.MarkReadParams
+	c.BindRPCParams(&params)
+	err := models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		h.User().NewSet(env).CurrentUser().MarkNotificationsRead(params.IDs)
+	})
+	c.RPC(http.StatusOK, nil, err)
+}
+
+// MarkAllNotificationsRead marks all the notifications of the current user as read
+func MarkAllNotificationsRead(c *server.Context) {
+	uid := c.Session().Get("uid").(int64)
+	web.CheckUser(uid)
+	err := models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		h.User().NewSet(env).CurrentUser().MarkAllNotificationsRead()
+	})
+	c.RPC(http.StatusOK, nil, err)
+}
+
+// UnreadCount returns the number of unread notifications of the current user
+func UnreadCount(c *server.Context) {
+	uid := c.Session().Get("uid").(int64)
+	web.CheckUser(uid)
+	var res int64
+	err := models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		res = h.User().NewSet(env).CurrentUser().UnreadNotificationCounts()[uid]
+	})
+	c.RPC(http.StatusOK, res, err)
+}
+
+// Receipts returns the receipts of the given notification, which must have been sent by the current user
+func Receipts(c *server.Context) {
+	uid := c.Session().Get("uid").(int64)
+	web.CheckUser(uid)
+	var params bustypes.ReceiptsParams
+	c.BindRPCParams(&params)
+	res := []bustypes.Receipt{}
+	var allowed bool
+	err := models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		notification := h.BusBus().NewSet(env).Sudo().Search(q.BusBus().ID().Equals(params.NotificationID))
+		if notification.IsEmpty() || notification.Sender().ID() != uid {
+			return
+		}
+		allowed = true
+		res = notification.Receipts()
+	})
+	if err == nil && !allowed {
+		err = exceptions.UserError{Message: "Only the sender of a notification can see its receipts"}
+	}
+	c.RPC(http.StatusOK, res, err)
+}
+
+// Devices returns the presence of each device of the given users
+func Devices(c *server.Context) {
+	uid := c.Session().Get("uid").(int64)
+	web.CheckUser(uid)
+	var params bustypes.DevicesParams
+	c.BindRPCParams(&params)
+	res := []bustypes.UserDevices{}
+	err := models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		users := h.User().Browse(env, params.UserIDs)
+		devices := users.IMDevices()
+		for _, id := range users.Ids() {
+			res = append(res, bustypes.UserDevices{
+				UserID:  id,
+				Devices: devices[id],
+			})
+		}
+	})
+	c.RPC(http.StatusOK, res, err)
+}
+
+// IMStatus returns the IM status of the given partners and users
+func IMStatus(c *server.Context) {
+	uid := c.Session().Get("uid").(int64)
+	web.CheckUser(uid)
+	var params bustypes.IMStatusParams
+	c.BindRPCParams(&params)
+	res := bustypes.IMStatusResult{
+		Partners: []bustypes.IMStatus{},
+		Users:    []bustypes.IMStatus{},
+		Guests:   []bustypes.IMStatus{},
+	}
+	err := models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		partners := h.Partner().Browse(env, params.PartnerIDs)
+		partnerStatuses := partners.IMStatuses()
+		partnerMessages := partners.IMStatusMessages()
+		partnerLastSeen := partners.IMLastSeen()
+		for _, id := range partners.Ids() {
+			status := bustypes.IMStatus{
+				ID:            id,
+				IMStatus:      partnerStatuses[id],
+				StatusMessage: partnerMessages[id],
+			}
+			if lastSeen, ok := partnerLastSeen[id]; ok {
+				status.LastSeen = &lastSeen
+			}
+			res.Partners = append(res.Partners, status)
+		}
+		users := h.User().Browse(env, params.UserIDs)
+		userStatuses := users.IMStatuses()
+		userMessages := users.IMStatusMessages()
+		userLastSeen := users.IMLastSeen()
+		for _, id := range users.Ids() {
+			status := bustypes.IMStatus{
+				ID:            id,
+				IMStatus:      userStatuses[id],
+				StatusMessage: userMessages[id],
+			}
+			if lastSeen, ok := userLastSeen[id]; ok {
+				status.LastSeen = &lastSeen
+			}
+			res.Users = append(res.Users, status)
+		}
+		if len(params.GuestIDs) == 0 {
+			return
+		}
+		guests := h.BusGuest().Browse(env, params.GuestIDs)
+		guestStatuses := guests.IMStatuses()
+		for _, id := range guests.Ids() {
+			res.Guests = append(res.Guests, bustypes.IMStatus{
+				ID:       id,
+				IMStatus: guestStatuses[id],
+			})
+		}
+	})
+	c.RPC(http.StatusOK, res, err)
+}
+
+// IMSearch returns the contacts matching the given search parameters with their IM status
+func IMSearch(c *server.Context) {
+	uid := c.Session().Get("uid").(int64)
+	web.CheckUser(uid)
+	var params bustypes.IMSearchParams
+	c.BindRPCParams(&params)
+	var res []bustypes.IMSearchResult
+	err := models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		res = h.Partner().NewSet(env).SearchIMContacts(params)
+	})
+	c.RPC(http.StatusOK, res, err)
+}
+
+// SetStatus sets the manual status and status message of the current user
+func SetStatus(c *server.Context) {
+	uid := c.Session().Get("uid").(int64)
+	web.CheckUser(uid)
+	var params bustypes.SetStatusParams
+	c.BindRPCParams(&params)
+	var expiry dates.DateTime
+	if params.Duration > 0 {
+		expiry = dates.Now().Add(time.Duration(params.Duration) * time.Second)
+	}
+	err := models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		h.User().NewSet(env).CurrentUser().SetPresenceStatus(params.Status, params.Message, expiry)
+	})
+	c.RPC(http.StatusOK, nil, err)
+}
+
+// SetPrivacy sets the presence privacy settings of the current user
+func SetPrivacy(c *server.Context) {
+	uid := c.Session().Get("uid").(int64)
+	web.CheckUser(uid)
+	var params bustypes.PrivacyParams
+	c.BindRPCParams(&params)
+	err := models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		h.User().NewSet(env).CurrentUser().SetPresencePrivacy(params.Visibility, params.ShowLastSeen, params.HideFromPortal)
+	})
+	c.RPC(http.StatusOK, nil, err)
+}
+
+// Snooze activates do not disturb for the current user for the given duration
+func Snooze(c *server.Context) {
+	uid := c.Session().Get("uid").(int64)
+	web.CheckUser(uid)
+	var params bustypes.SnoozeParams
+	c.BindRPCParams(&params)
+	var until dates.DateTime
+	if params.Duration > 0 {
+		until = dates.Now().Add(time.Duration(params.Duration) * time.Second)
+	}
+	err := models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		h.User().NewSet(env).CurrentUser().Snooze(until)
+	})
+	c.RPC(http.StatusOK, nil, err)
+}
+
+// PresenceTimers returns the presence timers that apply to the current user
+func PresenceTimers(c *server.Context) {
+	uid := c.Session().Get("uid").(int64)
+	web.CheckUser(uid)
+	var res bustypes.PresenceTimers
+	err := models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		res = h.User().NewSet(env).CurrentUser().PresenceTimers()
+	})
+	c.RPC(http.StatusOK, res, err)
+}
+
+// Listeners returns the connections that are currently listening on the given channel
+func Listeners(c *server.Context) {
+	uid := c.Session().Get("uid").(int64)
+	web.CheckUser(uid)
+	var params bustypes.ListenersParams
+	c.BindRPCParams(&params)
+	var res []bustypes.ChannelListener
+	err := models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		res = h.BusChannelListener().NewSet(env).Listeners(params.Channel)
+	})
+	c.RPC(http.StatusOK, res, err)
+}
+
+// Logout marks the current user offline on the device of the session before
+// logging out, so that watchers do not wait for the disconnection timer.
+func Logout(c *server.Context) {
+	uid, ok := c.Session().Get("uid").(int64)
+	if !ok || uid == 0 {
+		return
+	}
+	deviceKey, _ := c.Session().Get(DeviceKeySessionKey).(string)
+	// The original controller removes the session keys
+	c.Super()
+	if deviceKey == "" {
+		return
+	}
+	var transitions []bustypes.PresenceTransition
+	err := models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		transitions = h.BusPresence().NewSet(env).Disconnect(deviceKey)
+	})
+	if err != nil {
+		log.Warn("Unable to disconnect user presence", "uid", uid, "error", err)
+		return
+	}
+	FirePresenceChanges(transitions)
+}
+
 func init() {
 	log = logging.GetLogger("bus.controllers")
 	root := controllers.Registry
@@ -76,5 +491,26 @@ func init() {
 		longpolling.AddMiddleWare(web.LoginRequired)
 		longpolling.AddController(http.MethodPost, "/send", Send)
 		longpolling.AddController(http.MethodPost, "/poll", Poll)
+		longpolling.AddController(http.MethodPost, "/heartbeat", Heartbeat)
+		longpolling.AddController(http.MethodPost, "/ack", Ack)
+		longpolling.AddController(http.MethodPost, "/receipts", Receipts)
+		longpolling.AddController(http.MethodPost, "/inbox_count", InboxCount)
+		longpolling.AddController(http.MethodPost, "/notifications", Notifications)
+		longpolling.AddController(http.MethodPost, "/mark_notifications_read", MarkNotificationsRead)
+		longpolling.AddController(http.MethodPost, "/mark_all_notifications_read", MarkAllNotificationsRead)
+		longpolling.AddController(http.MethodPost, "/unread_count", UnreadCount)
+		longpolling.AddController(http.MethodPost, "/im_status", IMStatus)
+		longpolling.AddController(http.MethodPost, "/devices", Devices)
+		longpolling.AddController(http.MethodPost, "/im_search", IMSearch)
+		longpolling.AddController(http.MethodPost, "/set_status", SetStatus)
+		longpolling.AddController(http.MethodPost, "/snooze", Snooze)
+		longpolling.AddController(http.MethodPost, "/set_privacy", SetPrivacy)
+		longpolling.AddController(http.MethodPost, "/presence_timers", PresenceTimers)
+		longpolling.AddController(http.MethodPost, "/listeners", Listeners)
+	}
+	guest := root.AddGroup("/longpolling/guest")
+	{
+		guest.AddController(http.MethodPost, "/heartbeat", GuestHeartbeat)
 	}
+	root.MustGetGroup("/web").MustGetGroup("/session").ExtendController(http.MethodGet, "/logout", Logout)
 }
@@ -0,0 +1,83 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"errors"
+
+	"github.com/hexya-addons/bus/bustypes"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
+)
+
+// desktopNotificationMessageType is the message type of the desktop notifications sent on the user channel
+const desktopNotificationMessageType = "bus.desktop_notification"
+
+// ErrNoTitle is returned when sending a desktop notification without title.
+var ErrNoTitle = errors.New("desktop notifications require a title")
+
+/* Desktop Notifications
+Desktop notifications are shown by the bus service of the recipients' clients: as
+a browser notification if the user allowed them, or as a toast otherwise. They are
+sent to users, to the users of groups or to the users of partners with the
+NotifyDesktop methods, on the UserChannel of each user as
+{type: 'bus.desktop_notification', notification: DesktopNotification}.
+
+They are alerts, so that they are deferred to the digest of users in do not disturb.
+Unlike the notification center, they are not stored.
+*/
+
+// sendDesktopNotification sends the given desktop notification to the given users
+func sendDesktopNotification(users m.UserSet, notification bustypes.DesktopNotification) error {
+	if notification.Title == "" {
+		return ErrNoTitle
+	}
+	var notifications []*bustypes.Notification
+	for _, id := range users.Ids() {
+		notifications = append(notifications, &bustypes.Notification{
+			Channel: UserChannel(id),
+			Message: map[string]interface{}{
+				"type":         desktopNotificationMessageType,
+				"notification": notification,
+			},
+			MessageType: desktopNotificationMessageType,
+			Alert:       true,
+		})
+	}
+	if len(notifications) == 0 {
+		return nil
+	}
+	return h.BusBus().NewSet(users.Env()).SendmanyE(notifications)
+}
+
+// NotifyDesktop shows the given desktop notification to the users of this recordset.
+func user_NotifyDesktop(rs m.UserSet, notification bustypes.DesktopNotification) error {
+	return sendDesktopNotification(rs, notification)
+}
+
+// NotifyDesktop shows the given desktop notification to the users of the groups of this recordset.
+func group_NotifyDesktop(rs m.GroupSet, notification bustypes.DesktopNotification) error {
+	users := h.User().NewSet(rs.Env())
+	if !rs.IsEmpty() {
+		users = users.Sudo().Search(q.User().Groups().In(rs))
+	}
+	return sendDesktopNotification(users, notification)
+}
+
+// NotifyDesktop shows the given desktop notification to the users of the partners of this recordset.
+// Partners without user are ignored.
+func partner_NotifyDesktop(rs m.PartnerSet, notification bustypes.DesktopNotification) error {
+	users := h.User().NewSet(rs.Env())
+	if !rs.IsEmpty() {
+		users = users.Sudo().Search(q.User().Partner().In(rs))
+	}
+	return sendDesktopNotification(users, notification)
+}
+
+func init() {
+	h.User().NewMethod("NotifyDesktop", user_NotifyDesktop)
+	h.Group().NewMethod("NotifyDesktop", group_NotifyDesktop)
+	h.Partner().NewMethod("NotifyDesktop", partner_NotifyDesktop)
+}
@@ -0,0 +1,85 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"testing"
+
+	"github.com/hexya-addons/base"
+	"github.com/hexya-addons/bus/bustypes"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/q"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDesktopNotifications(t *testing.T) {
+	Convey("Testing desktop notifications", t, func() {
+		models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			user := h.User().Search(env, q.User().Login().Equals("admin"))
+			marker := &bustypes.Notification{Channel: UserChannel(user.ID()), Message: "marker"}
+			So(h.BusBus().NewSet(env).SendmanyE([]*bustypes.Notification{marker}), ShouldBeNil)
+			received := func() []*bustypes.Notification {
+				var res []*bustypes.Notification
+				for _, notif := range h.BusBus().NewSet(env).Poll([]string{UserChannel(user.ID())}, marker.ID, types.NewContext(), false) {
+					if notif.MessageType == desktopNotificationMessageType {
+						res = append(res, notif)
+					}
+				}
+				return res
+			}
+			notification := bustypes.DesktopNotification{
+				Title: "Order shipped",
+				Body:  "SO042 left the warehouse",
+				Sound: true,
+				ClickAction: &bustypes.ClickAction{
+					ResModel: "SaleOrder",
+					ResID:    42,
+				},
+			}
+			Convey("Users receive desktop notifications as alerts", func() {
+				So(user.NotifyDesktop(notification), ShouldBeNil)
+				notifs := received()
+				So(notifs, ShouldHaveLength, 1)
+				So(notifs[0].Alert, ShouldBeTrue)
+				message := notifs[0].Message.(map[string]interface{})
+				So(message["type"], ShouldEqual, desktopNotificationMessageType)
+				content := message["notification"].(map[string]interface{})
+				So(content["title"], ShouldEqual, "Order shipped")
+				So(content["sound"], ShouldBeTrue)
+				So(content["click_action"].(map[string]interface{})["res_model"], ShouldEqual, "SaleOrder")
+			})
+			Convey("Groups and partners notify their users", func() {
+				employees := h.Group().Search(env, q.Group().GroupID().Equals(base.GroupUser.ID()))
+				So(employees.NotifyDesktop(notification), ShouldBeNil)
+				So(received(), ShouldHaveLength, 1)
+				So(user.Partner().NotifyDesktop(notification), ShouldBeNil)
+				So(received(), ShouldHaveLength, 2)
+			})
+			Convey("Desktop notifications require a title", func() {
+				So(user.NotifyDesktop(bustypes.DesktopNotification{Body: "No title"}), ShouldEqual, ErrNoTitle)
+				So(received(), ShouldBeEmpty)
+			})
+			Convey("Clients cannot send desktop notifications", func() {
+				clientBus := h.BusBus().NewSet(env).Sudo(user.ID())
+				forged := map[string]interface{}{
+					"type":         desktopNotificationMessageType,
+					"notification": notification,
+				}
+				So(clientBus.SendFromClient(&bustypes.Notification{
+					Channel:     "desktop.shared",
+					Message:     forged,
+					MessageType: desktopNotificationMessageType,
+				}), ShouldNotBeNil)
+				So(clientBus.SendFromClient(&bustypes.Notification{
+					Channel: "desktop.shared",
+					Message: forged,
+				}), ShouldNotBeNil)
+				So(h.BusBus().Search(env, q.BusBus().Channel().Equals("desktop.shared")).IsEmpty(), ShouldBeTrue)
+			})
+		})
+	})
+}
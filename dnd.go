@@ -0,0 +1,261 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hexya-addons/bus/bustypes"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/fields"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
+)
+
+const (
+	// digestMessageType is the message type of the digests of the alerts received during do not disturb
+	digestMessageType = "bus.digest"
+	// dndMessageType is the message type of the do not disturb state changes sent on the user channel
+	dndMessageType = "bus.dnd"
+	// digestRetention is the duration after which undelivered digest entries are removed
+	digestRetention = 7 * 24 * time.Hour
+	// dndPollMiddlewareSequence is the sequence of the poll middleware that defers alerts,
+	// so that it runs after application middlewares.
+	dndPollMiddlewareSequence = 1000
+)
+
+/* Do Not Disturb
+A user is in do not disturb (DND) when they snoozed their notifications, or when
+they enabled the DND schedule and are outside their working hours in their time zone.
+
+While in DND, the user's status is 'dnd' and the notifications sent with the Alert flag
+are still delivered, but without the flag, so that clients do not show popups or beep.
+They are queued in the user's digest instead, which is sent on the user's channel when
+DND ends.
+*/
+
+var fields_BusDigest = map[string]models.FieldDefinition{
+	"User": fields.Many2One{
+		RelationModel: h.User(),
+		Required:      true,
+		Index:         true,
+		OnDelete:      `cascade`},
+
+	"BusID": fields.Integer{
+		String: "Notification ID",
+		Help:   "ID of the bus notification from which this entry has been queued"},
+
+	"Channel": fields.Char{},
+
+	"Message": fields.Text{
+		Help: "JSON encoded message"},
+
+	"MessageType": fields.Char{},
+}
+
+// userChannelPrefix is the prefix of the users' channels
+const userChannelPrefix = "bus.user."
+
+// UserChannel returns the name of the bus channel on which the notifications
+// specific to the user with the given ID are sent.
+func UserChannel(uid int64) string {
+	return fmt.Sprintf("%s%d", userChannelPrefix, uid)
+}
+
+// inWorkingHours returns true if the given hour of the day is within the working hours
+// from and to. Working hours cross midnight if to is lower than from.
+func inWorkingHours(hour, from, to float64) bool {
+	if from <= to {
+		return hour >= from && hour < to
+	}
+	return hour >= from || hour < to
+}
+
+// IsDND returns true if do not disturb is active for this user at the given date.
+func busPresenceSettings_IsDND(rs m.BusPresenceSettingsSet, now dates.DateTime) bool {
+	if !rs.SnoozeUntil().IsZero() && rs.SnoozeUntil().Greater(now) {
+		return true
+	}
+	if !rs.DNDSchedule() {
+		return false
+	}
+	loc := time.UTC
+	if tz := rs.User().TZ(); tz != "" {
+		if l, err := time.LoadLocation(tz); err == nil {
+			loc = l
+		}
+	}
+	local := now.Time.In(loc)
+	if rs.DNDWeekends() && (local.Weekday() == time.Saturday || local.Weekday() == time.Sunday) {
+		return true
+	}
+	hour := float64(local.Hour()) + float64(local.Minute())/60
+	return !inWorkingHours(hour, rs.WorkHourFrom(), rs.WorkHourTo())
+}
+
+// UpdateDND detects the do not disturb transitions of all users. It publishes the status
+// changes, notifies the users' clients on their UserChannel and delivers the digest of
+// the users whose do not disturb ended.
+func busPresenceSettings_UpdateDND(rs m.BusPresenceSettingsSet) {
+	settings := h.BusPresenceSettings().NewSet(rs.Env()).Sudo().Search(
+		q.BusPresenceSettings().DNDSchedule().Equals(true).
+			Or().SnoozeUntil().IsNotNull().
+			Or().DNDActive().Equals(true))
+	now := presenceNow()
+	partners := h.Partner().NewSet(rs.Env())
+	ended := h.User().NewSet(rs.Env())
+	var notifications []*bustypes.Notification
+	for _, setting := range settings.Records() {
+		dnd := setting.IsDND(now)
+		if dnd == setting.DNDActive() {
+			continue
+		}
+		setting.SetDNDActive(dnd)
+		user := setting.User()
+		partners = partners.Union(user.Partner())
+		if !dnd {
+			ended = ended.Union(user)
+		}
+		notifications = append(notifications, &bustypes.Notification{
+			Channel:     UserChannel(user.ID()),
+			Message:     map[string]interface{}{"type": dndMessageType, "active": dnd},
+			MessageType: dndMessageType,
+		})
+	}
+	if len(notifications) == 0 {
+		return
+	}
+	if err := h.BusBus().NewSet(rs.Env()).SendmanyE(notifications); err != nil {
+		log.Warn("Unable to publish do not disturb changes", "error", err)
+	}
+	publishPartnersStatus(partners)
+	h.BusDigest().NewSet(rs.Env()).Deliver(ended)
+}
+
+// Queue adds the given notification to the digest of the given user.
+// A notification with an ID is queued only once per user.
+func busDigest_Queue(rs m.BusDigestSet, user m.UserSet, notification *bustypes.Notification) {
+	digests := h.BusDigest().NewSet(rs.Env()).Sudo()
+	if notification.ID != 0 && !digests.Search(q.BusDigest().User().Equals(user).
+		And().BusID().Equals(notification.ID)).IsEmpty() {
+		return
+	}
+	msgData, err := json.Marshal(notification.Message)
+	if err != nil {
+		log.Warn("Unable to queue notification in digest", "channel", notification.Channel, "error", err)
+		return
+	}
+	data := h.BusDigest().NewData().
+		SetUser(user).
+		SetChannel(notification.Channel).
+		SetMessage(string(msgData)).
+		SetMessageType(notification.MessageType)
+	if notification.ID != 0 {
+		// Notifications without ID (e.g. not stored yet) are left NULL so that
+		// they do not collide on the user_bus_uniq constraint.
+		data.SetBusID(notification.ID)
+	}
+	digests.Create(data)
+}
+
+// Deliver sends the digest of each of the given users on their UserChannel and empties it.
+//
+// A digest message has the form {type: 'bus.digest', notifications: [{channel, message, message_type}]}.
+func busDigest_Deliver(rs m.BusDigestSet, users m.UserSet) {
+	if users.IsEmpty() {
+		return
+	}
+	digests := h.BusDigest().NewSet(rs.Env()).Sudo().Search(q.BusDigest().User().In(users)).OrderBy("ID")
+	if digests.IsEmpty() {
+		return
+	}
+	entries := make(map[int64][]map[string]interface{})
+	for _, digest := range digests.Records() {
+		var message interface{}
+		if err := json.Unmarshal([]byte(digest.Message()), &message); err != nil {
+			log.Warn("Skipping corrupted digest entry", "id", digest.ID(), "error", err)
+			continue
+		}
+		userID := digest.User().ID()
+		entries[userID] = append(entries[userID], map[string]interface{}{
+			"channel":      digest.Channel(),
+			"message":      message,
+			"message_type": digest.MessageType(),
+		})
+	}
+	var notifications []*bustypes.Notification
+	for userID, userEntries := range entries {
+		notifications = append(notifications, &bustypes.Notification{
+			Channel: UserChannel(userID),
+			Message: map[string]interface{}{
+				"type":          digestMessageType,
+				"notifications": userEntries,
+			},
+			MessageType: digestMessageType,
+		})
+	}
+	if err := h.BusBus().NewSet(rs.Env()).SendmanyE(notifications); err != nil {
+		log.Warn("Unable to deliver digests, will retry", "error", err)
+		return
+	}
+	digests.Unlink()
+}
+
+// Gc removes the digest entries that could not be delivered for digestRetention.
+func busDigest_Gc(rs m.BusDigestSet) int64 {
+	limit := dates.Now().Add(-digestRetention)
+	return h.BusDigest().NewSet(rs.Env()).Sudo().Search(q.BusDigest().CreateDate().Lower(limit)).Unlink()
+}
+
+// Snooze activates do not disturb for these users until the given date.
+// A zero date cancels the snooze.
+func user_Snooze(rs m.UserSet, until dates.DateTime) {
+	for _, user := range rs.Records() {
+		setting := h.BusPresenceSettings().NewSet(rs.Env()).Sudo().Search(q.BusPresenceSettings().User().Equals(user))
+		if setting.IsEmpty() {
+			h.BusPresenceSettings().NewSet(rs.Env()).Sudo().Create(h.BusPresenceSettings().NewData().
+				SetUser(user).
+				SetSnoozeUntil(until))
+			continue
+		}
+		setting.SetSnoozeUntil(until)
+	}
+	h.BusPresenceSettings().NewSet(rs.Env()).UpdateDND()
+}
+
+// dndPollMiddleware removes the Alert flag of the notifications polled by users in
+// do not disturb and queues them in their digest.
+func dndPollMiddleware(env models.Environment, notification *bustypes.Notification) []*bustypes.Notification {
+	if !notification.Alert {
+		return []*bustypes.Notification{notification}
+	}
+	user := h.User().NewSet(env).CurrentUser()
+	if !usersPresenceSettings(user)[user.ID()].dnd {
+		return []*bustypes.Notification{notification}
+	}
+	h.BusDigest().NewSet(env).Queue(user, notification)
+	deferred := *notification
+	deferred.Alert = false
+	return []*bustypes.Notification{&deferred}
+}
+
+func init() {
+	models.NewModel("BusDigest")
+	h.BusDigest().AddFields(fields_BusDigest)
+	h.BusDigest().NewMethod("Queue", busDigest_Queue)
+	h.BusDigest().NewMethod("Deliver", busDigest_Deliver)
+	h.BusDigest().NewMethod("Gc", busDigest_Gc)
+	h.BusDigest().AddSQLConstraint("user_bus_uniq", "unique(user_id, bus_id)", "A notification can only be queued once per user")
+
+	h.BusPresenceSettings().NewMethod("IsDND", busPresenceSettings_IsDND)
+	h.BusPresenceSettings().NewMethod("UpdateDND", busPresenceSettings_UpdateDND)
+
+	h.User().NewMethod("Snooze", user_Snooze)
+
+	RegisterPollMiddleware(dndPollMiddlewareSequence, dndPollMiddleware)
+}
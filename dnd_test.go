@@ -0,0 +1,92 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hexya-addons/bus/bustypes"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/q"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDND(t *testing.T) {
+	Convey("Testing do not disturb", t, func() {
+		Convey("Working hours can cross midnight", func() {
+			So(inWorkingHours(10, 8, 18), ShouldBeTrue)
+			So(inWorkingHours(18, 8, 18), ShouldBeFalse)
+			So(inWorkingHours(7.5, 8, 18), ShouldBeFalse)
+			So(inWorkingHours(23, 22, 6), ShouldBeTrue)
+			So(inWorkingHours(3, 22, 6), ShouldBeTrue)
+			So(inWorkingHours(12, 22, 6), ShouldBeFalse)
+		})
+		models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			user := h.User().Create(env, h.User().NewData().SetName("DND User").SetLogin("dnd_user").SetTZ("Europe/Paris"))
+			h.BusPresence().Create(env, h.BusPresence().NewData().
+				SetUser(user).
+				SetLastPoll(dates.Now()).
+				SetLastPresence(dates.Now()))
+			Convey("Schedules are evaluated in the user's time zone", func() {
+				settings := h.BusPresenceSettings().Create(env, h.BusPresenceSettings().NewData().
+					SetUser(user).
+					SetDNDSchedule(true).
+					SetWorkHourFrom(22).
+					SetWorkHourTo(6))
+				// 2020-06-10 is a Wednesday, Paris is UTC+2
+				night := dates.DateTime{Time: time.Date(2020, 6, 10, 21, 0, 0, 0, time.UTC)}
+				day := dates.DateTime{Time: time.Date(2020, 6, 10, 12, 0, 0, 0, time.UTC)}
+				So(settings.IsDND(night), ShouldBeFalse)
+				So(settings.IsDND(day), ShouldBeTrue)
+				Convey("Weekends can be out of working hours", func() {
+					saturday := dates.DateTime{Time: time.Date(2020, 6, 13, 21, 0, 0, 0, time.UTC)}
+					So(settings.IsDND(saturday), ShouldBeFalse)
+					settings.SetDNDWeekends(true)
+					So(settings.IsDND(saturday), ShouldBeTrue)
+				})
+			})
+			Convey("Snoozed users have the dnd status", func() {
+				user.Snooze(dates.Now().Add(time.Hour))
+				So(user.IMStatus(), ShouldEqual, "dnd")
+				So(user.Partner().IMStatus(), ShouldEqual, "dnd")
+				settings := h.BusPresenceSettings().Search(env, q.BusPresenceSettings().User().Equals(user))
+				So(settings.DNDActive(), ShouldBeTrue)
+				Convey("Invisible takes precedence over dnd", func() {
+					user.SetPresenceStatus("invisible", "", dates.DateTime{})
+					So(user.IMStatus(), ShouldEqual, "offline")
+				})
+				Convey("Alerts are deferred to a digest delivered when dnd ends", func() {
+					userEnv := h.User().NewSet(env).Sudo(user.ID()).Env()
+					alert := &bustypes.Notification{ID: 42, Channel: "dnd.chan", Message: "ping", Alert: true}
+					res := dndPollMiddleware(userEnv, alert)
+					So(res, ShouldHaveLength, 1)
+					So(res[0].Alert, ShouldBeFalse)
+					So(alert.Alert, ShouldBeTrue)
+					// Polling the same notification again does not queue it twice
+					dndPollMiddleware(userEnv, alert)
+					So(h.BusDigest().Search(env, q.BusDigest().User().Equals(user)).Len(), ShouldEqual, 1)
+					// Notifications without ID are all queued
+					h.BusDigest().NewSet(env).Queue(user, &bustypes.Notification{Channel: "dnd.chan", Message: "a", Alert: true})
+					h.BusDigest().NewSet(env).Queue(user, &bustypes.Notification{Channel: "dnd.chan", Message: "b", Alert: true})
+					So(h.BusDigest().Search(env, q.BusDigest().User().Equals(user)).Len(), ShouldEqual, 3)
+					plain := &bustypes.Notification{ID: 43, Channel: "dnd.chan", Message: "info"}
+					So(dndPollMiddleware(userEnv, plain)[0], ShouldEqual, plain)
+
+					user.Snooze(dates.DateTime{})
+					So(settings.DNDActive(), ShouldBeFalse)
+					So(user.IMStatus(), ShouldEqual, "online")
+					So(h.BusDigest().Search(env, q.BusDigest().User().Equals(user)).IsEmpty(), ShouldBeTrue)
+					digests := h.BusBus().Search(env, q.BusBus().Channel().Equals(UserChannel(user.ID())).
+						And().MessageType().Equals(digestMessageType))
+					So(digests.Len(), ShouldEqual, 1)
+					So(digests.Message(), ShouldContainSubstring, `"ping"`)
+				})
+			})
+		})
+	})
+}
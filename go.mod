@@ -9,4 +9,5 @@ require (
 	github.com/hexya-erp/pool v1.0.2
 	github.com/lib/pq v1.2.0
 	github.com/smartystreets/goconvey v0.0.0-20190306220146-200a235640ff
+	github.com/xeipuuv/gojsonschema v1.2.0
 )
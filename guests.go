@@ -0,0 +1,296 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hexya-addons/bus/bustypes"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/fields"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
+)
+
+const (
+	// guestSecretParam is the ConfigParameter key of the secret used to sign guest tokens
+	guestSecretParam = "bus.guest_secret"
+	// guestTokenValidityParam is the ConfigParameter key of the number of days guest tokens are valid
+	guestTokenValidityParam = "bus.guest_token_validity_days"
+	// defaultGuestTokenValidityDays is the number of days guest tokens are valid if not configured
+	defaultGuestTokenValidityDays = 30
+	// guestPresenceChannelPrefix is the prefix of the guests' presence channels
+	guestPresenceChannelPrefix = "bus.guest_presence."
+)
+
+/* Guest Presence
+Guests are the entities that have a presence without being users: website visitors
+(e.g. of a live chat) and bots or integrations calling the server with an API key.
+
+Guests authenticate with a signed token returned by their Token method. Tokens expire
+after the configured validity and are revoked when a new one is issued with
+RotateToken or when the guest is deleted. They send
+heartbeats with their inactivity like users' devices, and their status is computed
+with the global presence timers. Status changes are published on their
+GuestPresenceChannel and, if the guest is linked to a partner, on the partner's
+presence channel so that a chatbot appears online to users.
+*/
+
+var fields_BusGuest = map[string]models.FieldDefinition{
+	"Name": fields.Char{
+		Required: true},
+
+	"Kind": fields.Selection{
+		Selection: types.Selection{
+			"visitor": "Website Visitor",
+			"bot":     "Bot",
+		},
+		Required: true,
+		Default:  models.DefaultValue("visitor")},
+
+	"Partner": fields.Many2One{
+		RelationModel: h.Partner(),
+		OnDelete:      `cascade`,
+		Help:          "The partner whose status includes this guest's, e.g. the partner of a chatbot"},
+
+	"LastPoll": fields.DateTime{
+		String: "Last Poll"},
+
+	"LastPresence": fields.DateTime{
+		String: "Last Presence"},
+
+	"Status": fields.Selection{
+		Selection: types.Selection{
+			"online":  "Online",
+			"away":    "Away",
+			"offline": "Offline",
+		},
+		String:  "IM Status",
+		Default: models.DefaultValue("offline")},
+
+	"TokenNonce": fields.Char{
+		String: "Token Nonce",
+		Help:   "Random value signed in the current token of the guest. Changing it revokes the token."},
+
+	"TokenIssueDate": fields.DateTime{
+		String: "Token Issue Date"},
+}
+
+// GuestPresenceChannel returns the name of the bus channel on which the status
+// changes of the guest with the given ID are published.
+func GuestPresenceChannel(guestID int64) string {
+	return fmt.Sprintf("%s%d", guestPresenceChannelPrefix, guestID)
+}
+
+// initGuestSecret generates the secret used to sign guest tokens if it does not exist yet.
+//
+// It is called at startup and runs in its own transaction, so that the unique key
+// of the parameter rejects the secrets generated concurrently by other servers.
+func initGuestSecret() {
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		params := h.ConfigParameter().NewSet(env).Sudo()
+		if params.GetParam(guestSecretParam, "") != "" {
+			return
+		}
+		data := make([]byte, 32)
+		if _, err := rand.Read(data); err != nil {
+			panic(fmt.Errorf("unable to generate the guest secret: %s", err))
+		}
+		params.SetParam(guestSecretParam, hex.EncodeToString(data))
+	})
+	if err != nil {
+		log.Debug("Guest secret not created, it may have been created concurrently", "error", err)
+	}
+}
+
+// guestSecret returns the secret used to sign guest tokens, generating it if needed.
+func guestSecret(env models.Environment) []byte {
+	params := h.ConfigParameter().NewSet(env).Sudo()
+	secret := params.GetParam(guestSecretParam, "")
+	if secret == "" {
+		initGuestSecret()
+		secret = params.GetParam(guestSecretParam, "")
+	}
+	if secret == "" {
+		panic(fmt.Errorf("unable to get the guest secret"))
+	}
+	return []byte(secret)
+}
+
+// guestSignature returns the signature of the token of the guest with the given ID and nonce
+func guestSignature(env models.Environment, guestID int64, nonce string) string {
+	mac := hmac.New(sha256.New, guestSecret(env))
+	mac.Write([]byte(fmt.Sprintf("%d.%s", guestID, nonce)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// guestTokenValidity returns the duration during which guest tokens are valid
+func guestTokenValidity(env models.Environment) time.Duration {
+	days, err := strconv.Atoi(h.ConfigParameter().NewSet(env).Sudo().GetParam(guestTokenValidityParam, ""))
+	if err != nil || days <= 0 {
+		days = defaultGuestTokenValidityDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// guestTokenExpired returns true if the token of the given guest has never been
+// issued or has expired.
+func guestTokenExpired(guest m.BusGuestSet) bool {
+	if guest.TokenNonce() == "" || guest.TokenIssueDate().IsZero() {
+		return true
+	}
+	return !presenceNow().Lower(guest.TokenIssueDate().Add(guestTokenValidity(guest.Env())))
+}
+
+// Token returns the signed token with which this guest authenticates.
+//
+// A new token is issued if the guest has none or if it has expired.
+func busGuest_Token(rs m.BusGuestSet) string {
+	rs.EnsureOne()
+	if guestTokenExpired(rs) {
+		return rs.RotateToken()
+	}
+	return fmt.Sprintf("%d.%s.%s", rs.ID(), rs.TokenNonce(), guestSignature(rs.Env(), rs.ID(), rs.TokenNonce()))
+}
+
+// RotateToken issues a new token for this guest and returns it. The previous token
+// of the guest is revoked.
+func busGuest_RotateToken(rs m.BusGuestSet) string {
+	rs.EnsureOne()
+	data := make([]byte, 16)
+	if _, err := rand.Read(data); err != nil {
+		panic(fmt.Errorf("unable to generate the guest token nonce: %s", err))
+	}
+	rs.Sudo().Write(h.BusGuest().NewData().
+		SetTokenNonce(hex.EncodeToString(data)).
+		SetTokenIssueDate(presenceNow()))
+	return rs.Token()
+}
+
+// FromToken returns the guest authenticated by the given token, or an empty
+// recordset if the token is invalid, has expired or has been rotated.
+func busGuest_FromToken(rs m.BusGuestSet, token string) m.BusGuestSet {
+	res := h.BusGuest().NewSet(rs.Env())
+	parts := strings.SplitN(token, ".", 3)
+	if len(parts) != 3 {
+		return res
+	}
+	guestID, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return res
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(guestSignature(rs.Env(), guestID, parts[1]))) {
+		return res
+	}
+	guest := h.BusGuest().NewSet(rs.Env()).Sudo().Search(q.BusGuest().ID().Equals(guestID))
+	if guest.IsEmpty() || guestTokenExpired(guest) ||
+		!hmac.Equal([]byte(parts[1]), []byte(guest.TokenNonce())) {
+		return res
+	}
+	return guest
+}
+
+// Heartbeat records that this guest is connected and has been inactive for the given duration.
+func busGuest_Heartbeat(rs m.BusGuestSet, inactivity time.Duration) {
+	now := presenceNow()
+	lastPresence := now.Add(-inactivity)
+	for _, guest := range rs.Records() {
+		values := h.BusGuest().NewData().SetLastPoll(now)
+		if guest.LastPresence().Lower(lastPresence) {
+			values.SetLastPresence(lastPresence)
+		}
+		guest.Write(values)
+	}
+	rs.UpdateStatus()
+}
+
+// UpdateStatus updates the stored status of these guests from their last poll and last
+// presence dates and publishes the changes on the guests' and partners' presence channels.
+func busGuest_UpdateStatus(rs m.BusGuestSet) {
+	timers := globalPresenceTimers(rs.Env())
+	partners := h.Partner().NewSet(rs.Env())
+	var notifications []*bustypes.Notification
+	for _, guest := range rs.Records() {
+		status := computeStatus(guest.LastPoll(), guest.LastPresence(), timers)
+		if status == guest.Status() {
+			continue
+		}
+		guest.SetStatus(status)
+		notifications = append(notifications, &bustypes.Notification{
+			Channel: GuestPresenceChannel(guest.ID()),
+			Message: map[string]interface{}{
+				"id":        guest.ID(),
+				"im_status": status,
+			},
+		})
+		partners = partners.Union(guest.Partner())
+	}
+	if len(notifications) > 0 {
+		if err := h.BusBus().NewSet(rs.Env()).SendmanyE(notifications); err != nil {
+			log.Warn("Unable to publish guest presence changes", "error", err)
+		}
+	}
+	publishPartnersStatus(partners)
+}
+
+// IMStatuses returns the IM status of each guest of this recordset, by guest ID.
+func busGuest_IMStatuses(rs m.BusGuestSet) map[int64]string {
+	res := make(map[int64]string)
+	if rs.IsEmpty() {
+		return res
+	}
+	timers := globalPresenceTimers(rs.Env())
+	for _, guest := range rs.Records() {
+		res[guest.ID()] = computeStatus(guest.LastPoll(), guest.LastPresence(), timers)
+	}
+	return res
+}
+
+// Gc removes the website visitors that have not sent a heartbeat for presenceDeviceRetention.
+// Bots are kept.
+func busGuest_Gc(rs m.BusGuestSet) int64 {
+	limit := presenceNow().Add(-presenceDeviceRetention)
+	return h.BusGuest().NewSet(rs.Env()).Sudo().Search(
+		q.BusGuest().Kind().Equals("visitor").
+			AndCond(q.BusGuest().LastPoll().Lower(limit).
+				OrCond(q.BusGuest().LastPoll().IsNull().And().CreateDate().Lower(limit)))).Unlink()
+}
+
+// partnersGuestsStatuses returns the best status of the guests linked to the given partners, by partner ID
+func partnersGuestsStatuses(partners m.PartnerSet) map[int64]string {
+	res := make(map[int64]string)
+	if partners.IsEmpty() {
+		return res
+	}
+	guests := h.BusGuest().NewSet(partners.Env()).Sudo().Search(q.BusGuest().Partner().In(partners)).
+		Load(q.BusGuest().Partner(), q.BusGuest().LastPoll(), q.BusGuest().LastPresence())
+	statuses := guests.IMStatuses()
+	for _, guest := range guests.Records() {
+		partnerID := guest.Partner().ID()
+		res[partnerID] = bestStatus(res[partnerID], statuses[guest.ID()])
+	}
+	return res
+}
+
+func init() {
+	models.NewModel("BusGuest")
+	h.BusGuest().AddFields(fields_BusGuest)
+	h.BusGuest().NewMethod("Token", busGuest_Token)
+	h.BusGuest().NewMethod("RotateToken", busGuest_RotateToken)
+	h.BusGuest().NewMethod("FromToken", busGuest_FromToken)
+	h.BusGuest().NewMethod("Heartbeat", busGuest_Heartbeat)
+	h.BusGuest().NewMethod("UpdateStatus", busGuest_UpdateStatus)
+	h.BusGuest().NewMethod("IMStatuses", busGuest_IMStatuses)
+	h.BusGuest().NewMethod("Gc", busGuest_Gc)
+}
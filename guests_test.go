@@ -0,0 +1,95 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/q"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestGuestPresence(t *testing.T) {
+	Convey("Testing guests presence", t, func() {
+		models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			botPartner := h.Partner().Create(env, h.Partner().NewData().SetName("Chatbot"))
+			bot := h.BusGuest().Create(env, h.BusGuest().NewData().
+				SetName("Chatbot").
+				SetKind("bot").
+				SetPartner(botPartner))
+			visitor := h.BusGuest().Create(env, h.BusGuest().NewData().SetName("Visitor"))
+			Convey("Guests are authenticated by their signed token", func() {
+				token := visitor.Token()
+				So(visitor.Token(), ShouldEqual, token)
+				So(h.BusGuest().NewSet(env).FromToken(token).Equals(visitor), ShouldBeTrue)
+				parts := strings.Split(token, ".")
+				So(h.BusGuest().NewSet(env).FromToken(fmt.Sprintf("%d.%s.%s", bot.ID(), parts[1], parts[2])).IsEmpty(), ShouldBeTrue)
+				So(h.BusGuest().NewSet(env).FromToken(fmt.Sprintf("%d.%s", visitor.ID(), parts[2])).IsEmpty(), ShouldBeTrue)
+				So(h.BusGuest().NewSet(env).FromToken("invalid").IsEmpty(), ShouldBeTrue)
+			})
+			Convey("Rotated tokens are revoked", func() {
+				token := visitor.Token()
+				rotated := visitor.RotateToken()
+				So(rotated, ShouldNotEqual, token)
+				So(h.BusGuest().NewSet(env).FromToken(token).IsEmpty(), ShouldBeTrue)
+				So(h.BusGuest().NewSet(env).FromToken(rotated).Equals(visitor), ShouldBeTrue)
+			})
+			Convey("Expired tokens are rejected and replaced", func() {
+				token := visitor.Token()
+				clock := NewFakeClock(dates.Now())
+				previous := SetClock(clock)
+				defer SetClock(previous)
+				clock.Advance(defaultGuestTokenValidityDays*24*time.Hour + time.Minute)
+				So(h.BusGuest().NewSet(env).FromToken(token).IsEmpty(), ShouldBeTrue)
+				renewed := visitor.Token()
+				So(renewed, ShouldNotEqual, token)
+				So(h.BusGuest().NewSet(env).FromToken(renewed).Equals(visitor), ShouldBeTrue)
+			})
+			Convey("The guest secret is created once for concurrent requests", func() {
+				var wg sync.WaitGroup
+				secrets := make([]string, 4)
+				for i := range secrets {
+					wg.Add(1)
+					go func(i int) {
+						defer wg.Done()
+						models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+							secrets[i] = string(guestSecret(env))
+						})
+					}(i)
+				}
+				wg.Wait()
+				for _, secret := range secrets {
+					So(secret, ShouldNotBeEmpty)
+					So(secret, ShouldEqual, secrets[0])
+				}
+			})
+			Convey("Guests status is computed from their heartbeats", func() {
+				So(visitor.IMStatuses()[visitor.ID()], ShouldEqual, "offline")
+				visitor.Heartbeat(0)
+				So(visitor.Status(), ShouldEqual, "online")
+				visitor.Heartbeat(2 * defaultAwayTimer)
+				So(visitor.IMStatuses()[visitor.ID()], ShouldEqual, "online")
+				visitor.Write(h.BusGuest().NewData().SetLastPresence(dates.Now().Add(-2 * defaultAwayTimer)))
+				visitor.UpdateStatus()
+				So(visitor.Status(), ShouldEqual, "away")
+				visitor.SetLastPoll(dates.Now().Add(-2 * defaultDisconnectionTimer))
+				h.BusGuest().Search(env, q.BusGuest().Status().NotEquals("offline")).UpdateStatus()
+				So(visitor.Status(), ShouldEqual, "offline")
+			})
+			Convey("A bot gives its status to its partner", func() {
+				So(botPartner.IMStatus(), ShouldEqual, "offline")
+				bot.Heartbeat(0)
+				So(botPartner.IMStatuses()[botPartner.ID()], ShouldEqual, "online")
+			})
+		})
+	})
+}
@@ -0,0 +1,61 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"sync"
+
+	"github.com/hexya-addons/bus/bustypes"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+)
+
+// A PresenceChangeHandler is called when the status of a user computed from its
+// activity changes. Statuses are 'online', 'away' or 'offline'.
+//
+// Handlers are called synchronously once the presence update is committed, each in its
+// own environment and transaction as the superuser, so that they see the new status of
+// the user and a failing handler cannot abort the presence update. Their panics are
+// logged and do not prevent the other handlers from being called.
+type PresenceChangeHandler func(env models.Environment, user m.UserSet, oldStatus, newStatus string)
+
+// presenceChangeHandlers holds the handlers registered with OnPresenceChange
+var presenceChangeHandlers struct {
+	sync.RWMutex
+	handlers []PresenceChangeHandler
+}
+
+// OnPresenceChange registers the given handler to be called on each status change of a user,
+// whether detected when the user polls or by the sweeper for the away and disconnection timers.
+func OnPresenceChange(handler PresenceChangeHandler) {
+	presenceChangeHandlers.Lock()
+	defer presenceChangeHandlers.Unlock()
+	presenceChangeHandlers.handlers = append(presenceChangeHandlers.handlers, handler)
+}
+
+// firePresenceChanges calls the registered PresenceChangeHandler for each of the given transitions.
+//
+// It must be called after the transaction in which the transitions were detected is committed.
+func firePresenceChanges(transitions []bustypes.PresenceTransition) {
+	presenceChangeHandlers.RLock()
+	defer presenceChangeHandlers.RUnlock()
+	for _, transition := range transitions {
+		for _, handler := range presenceChangeHandlers.handlers {
+			callPresenceChangeHandler(handler, transition)
+		}
+	}
+}
+
+// callPresenceChangeHandler calls the given handler in a new environment, logging its error if any
+func callPresenceChangeHandler(handler PresenceChangeHandler, transition bustypes.PresenceTransition) {
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		handler(env, h.User().BrowseOne(env, transition.UserID), transition.OldStatus, transition.NewStatus)
+	})
+	if err != nil {
+		log.Warn("Presence change handler failed", "user", transition.UserID, "old", transition.OldStatus,
+			"new", transition.NewStatus, "error", err)
+	}
+}
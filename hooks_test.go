@@ -0,0 +1,96 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hexya-addons/bus/bustypes"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPresenceHooks(t *testing.T) {
+	Convey("Testing presence change hooks", t, func() {
+		presenceChangeHandlers.RLock()
+		handlers := presenceChangeHandlers.handlers
+		presenceChangeHandlers.RUnlock()
+		// Handlers are called once the transitions are committed, so we work on a committed
+		// user whose presences are reset for each run
+		var userID int64
+		models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			user := h.User().Search(env, q.User().Login().Equals("hooks_user"))
+			if user.IsEmpty() {
+				user = h.User().Create(env, h.User().NewData().SetName("Hooks User").SetLogin("hooks_user"))
+			}
+			userID = user.ID()
+			h.BusPresence().Search(env, q.BusPresence().User().Equals(user)).Unlink()
+			h.BusPresenceHistory().Search(env, q.BusPresenceHistory().User().Equals(user)).Unlink()
+		})
+		presences := func(env models.Environment) m.BusPresenceSet {
+			return h.BusPresence().Search(env, q.BusPresence().User().Equals(h.User().BrowseOne(env, userID)))
+		}
+		poll := func() {
+			pendingPresences.add(userID, presenceUpdate{
+				device:       bustypes.Device{Key: "hooks-device"},
+				lastPoll:     presenceNow(),
+				lastPresence: presenceNow(),
+			})
+			flushPresences()
+		}
+		var changes, committed []string
+		OnPresenceChange(func(env models.Environment, user m.UserSet, oldStatus, newStatus string) {
+			panic("failing handler")
+		})
+		OnPresenceChange(func(env models.Environment, user m.UserSet, oldStatus, newStatus string) {
+			// A database error must not prevent the other handlers from being called
+			env.Cr().Execute("SELECT 1 FROM bus_no_such_table")
+		})
+		OnPresenceChange(func(env models.Environment, user m.UserSet, oldStatus, newStatus string) {
+			if user.Login() != "hooks_user" {
+				return
+			}
+			changes = append(changes, fmt.Sprintf("%s->%s", oldStatus, newStatus))
+			committed = append(committed, presences(env).Status())
+		})
+		Convey("Handlers are not called before the presence update is committed", func() {
+			models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+				presence := h.BusPresence().Create(env, h.BusPresence().NewData().
+					SetUser(h.User().BrowseOne(env, userID)).
+					SetLastPoll(dates.Now()).
+					SetLastPresence(dates.Now()))
+				transitions := presence.UpdateStatus()
+				So(transitions, ShouldHaveLength, 1)
+				So(transitions[0].NewStatus, ShouldEqual, "online")
+				So(changes, ShouldBeEmpty)
+			})
+		})
+		Convey("Handlers are called on committed transitions and their failures are ignored", func() {
+			poll()
+			So(changes, ShouldResemble, []string{"offline->online"})
+			So(committed, ShouldResemble, []string{"online"})
+			poll()
+			So(changes, ShouldHaveLength, 1)
+			Convey("Timer based transitions are detected by the sweeper", func() {
+				models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+					presences(env).SetLastPoll(dates.Now().Add(-2 * defaultDisconnectionTimer))
+				})
+				sweepPresences()
+				So(changes, ShouldResemble, []string{"offline->online", "online->offline"})
+				So(committed, ShouldResemble, []string{"online", "offline"})
+			})
+		})
+		Reset(func() {
+			presenceChangeHandlers.Lock()
+			presenceChangeHandlers.handlers = handlers
+			presenceChangeHandlers.Unlock()
+		})
+	})
+}
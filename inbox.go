@@ -0,0 +1,156 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/hexya-addons/bus/bustypes"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
+)
+
+/* User Inbox
+Notifications sent on a UserChannel with the Durable flag are kept in the inbox of
+the user until the user acknowledges them or for receiptRetention, so that users
+who are offline when they are sent get them when they come back.
+
+Pending inbox notifications are returned to each poll of the user on its UserChannel,
+whatever the last notification ID of the client, until one of its clients acknowledges
+them. They always require an acknowledgement, which clients send with the next poll.
+Polls only return right away for the inbox notifications that the client has not
+received yet, the other ones are returned with the next notifications or at timeout.
+*/
+
+// userChannelID returns the ID of the user of the given UserChannel, and false
+// if the channel is not a user channel.
+func userChannelID(channel string) (int64, bool) {
+	if !strings.HasPrefix(channel, userChannelPrefix) {
+		return 0, false
+	}
+	uid, err := strconv.ParseInt(strings.TrimPrefix(channel, userChannelPrefix), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return uid, true
+}
+
+// pendingInbox returns the durable notifications sent to the given users that
+// they have not acknowledged yet, ordered by ID.
+func pendingInbox(users m.UserSet) m.BusBusSet {
+	if users.IsEmpty() {
+		return h.BusBus().NewSet(users.Env())
+	}
+	channels := make([]string, 0, users.Len())
+	for _, id := range users.Ids() {
+		channels = append(channels, UserChannel(id))
+	}
+	notifications := h.BusBus().NewSet(users.Env()).Sudo().Search(
+		q.BusBus().Durable().Equals(true).
+			And().Channel().In(channels).
+			And().CreateDate().Greater(dates.Now().Add(-receiptRetention))).OrderBy("ID")
+	if notifications.IsEmpty() {
+		return notifications
+	}
+	acknowledged := make(map[int64]bool)
+	receipts := h.BusReceipt().NewSet(users.Env()).Sudo().Search(
+		q.BusReceipt().Notification().In(notifications).And().User().In(users))
+	for _, receipt := range receipts.Records() {
+		// Only the addressee of a notification can remove it from its inbox
+		if receipt.Notification().Channel() == UserChannel(receipt.User().ID()) {
+			acknowledged[receipt.Notification().ID()] = true
+		}
+	}
+	var ids []int64
+	for _, id := range notifications.Ids() {
+		if !acknowledged[id] {
+			ids = append(ids, id)
+		}
+	}
+	return h.BusBus().Browse(users.Env(), ids).Sudo()
+}
+
+// Inbox returns the durable notifications sent to this user that it has not acknowledged yet.
+func user_Inbox(rs m.UserSet) []*bustypes.Notification {
+	rs.EnsureOne()
+	res := toNotifications(pendingInbox(rs))
+	if res == nil {
+		res = []*bustypes.Notification{}
+	}
+	return res
+}
+
+// InboxCounts returns the number of durable notifications that the users of this
+// recordset have not acknowledged yet, by user ID.
+func user_InboxCounts(rs m.UserSet) map[int64]int64 {
+	res := make(map[int64]int64)
+	for _, id := range rs.Ids() {
+		res[id] = 0
+	}
+	for _, notification := range pendingInbox(rs).Records() {
+		if uid, ok := userChannelID(notification.Channel()); ok {
+			res[uid]++
+		}
+	}
+	return res
+}
+
+// pollInbox returns the pending inbox notifications of the user with the given uid
+// if it polls its UserChannel.
+func pollInbox(uid int64, channels []string) ([]*bustypes.Notification, error) {
+	var polled bool
+	for _, channel := range channels {
+		if channel == UserChannel(uid) {
+			polled = true
+			break
+		}
+	}
+	if !polled {
+		return nil, nil
+	}
+	var res []*bustypes.Notification
+	err := models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		res = h.User().BrowseOne(env, uid).Inbox()
+	})
+	return res, err
+}
+
+// hasNewNotifications returns true if some of the given inbox notifications have
+// an ID greater than last, that is if the client has not received them yet.
+func hasNewNotifications(inbox []*bustypes.Notification, last int64) bool {
+	for _, notif := range inbox {
+		if notif.ID > last {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeInbox returns the given inbox notifications followed by the given polled
+// notifications, without duplicates.
+func mergeInbox(inbox, notifications []*bustypes.Notification) []*bustypes.Notification {
+	if len(inbox) == 0 {
+		return notifications
+	}
+	polled := make(map[int64]bool)
+	for _, notif := range notifications {
+		polled[notif.ID] = true
+	}
+	var res []*bustypes.Notification
+	for _, notif := range inbox {
+		if !polled[notif.ID] {
+			res = append(res, notif)
+		}
+	}
+	return append(res, notifications...)
+}
+
+func init() {
+	h.User().NewMethod("Inbox", user_Inbox)
+	h.User().NewMethod("InboxCounts", user_InboxCounts)
+}
@@ -0,0 +1,79 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hexya-addons/bus/bustypes"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/q"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestInbox(t *testing.T) {
+	Convey("Testing durable notifications inbox", t, func() {
+		models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			// Notifications are committed, so the inbox may hold the ones of previous runs
+			user := h.User().Search(env, q.User().Login().Equals("admin"))
+			before := user.InboxCounts()[user.ID()]
+			export := &bustypes.Notification{
+				Channel: UserChannel(user.ID()),
+				Message: "Your export is ready",
+				Durable: true,
+			}
+			So(h.BusBus().NewSet(env).SendmanyE([]*bustypes.Notification{export}), ShouldBeNil)
+			Convey("Durable notifications wait in the inbox until acknowledged", func() {
+				So(user.InboxCounts()[user.ID()], ShouldEqual, before+1)
+				inbox := user.Sudo(user.ID()).Inbox()
+				So(inbox, ShouldNotBeEmpty)
+				last := inbox[len(inbox)-1]
+				So(last.ID, ShouldEqual, export.ID)
+				So(last.RequireAck, ShouldBeTrue)
+				So(last.Durable, ShouldBeTrue)
+				h.BusBus().NewSet(env).Sudo(user.ID()).Browse([]int64{export.ID}).Acknowledge(false)
+				So(user.InboxCounts()[user.ID()], ShouldEqual, before)
+			})
+			Convey("Other users cannot acknowledge them", func() {
+				h.BusBus().NewSet(env).Browse([]int64{export.ID}).Acknowledge(true)
+				So(user.InboxCounts()[user.ID()], ShouldEqual, before+1)
+			})
+			Convey("Durable notifications must be sent to users", func() {
+				err := h.BusBus().NewSet(env).SendmanyE([]*bustypes.Notification{{
+					Channel: "inbox.other",
+					Message: "Lost",
+					Durable: true,
+				}})
+				So(err, ShouldNotBeNil)
+			})
+			Convey("Polls do not return right away for inbox notifications already received", func() {
+				inbox := user.Sudo(user.ID()).Inbox()
+				So(hasNewNotifications(inbox, export.ID-1), ShouldBeTrue)
+				So(hasNewNotifications(inbox, export.ID), ShouldBeFalse)
+				start := time.Now()
+				res, err := newBusDispatcher().PollE(user.ID(), []string{UserChannel(user.ID())}, export.ID,
+					types.NewContext().WithKey("timeout", 1))
+				So(err, ShouldBeNil)
+				So(time.Since(start), ShouldBeGreaterThanOrEqualTo, time.Second)
+				var ids []int64
+				for _, notif := range res {
+					ids = append(ids, notif.ID)
+				}
+				So(ids, ShouldContain, export.ID)
+			})
+			Convey("Inbox notifications are merged with polled ones", func() {
+				polled := []*bustypes.Notification{{ID: export.ID}, {ID: export.ID + 1}}
+				So(mergeInbox([]*bustypes.Notification{{ID: 1}, {ID: export.ID}}, polled), ShouldHaveLength, 3)
+				So(mergeInbox(nil, polled), ShouldResemble, polled)
+				uid, ok := userChannelID(UserChannel(user.ID()))
+				So(ok, ShouldBeTrue)
+				So(uid, ShouldEqual, user.ID())
+			})
+		})
+	})
+}
@@ -0,0 +1,303 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hexya-addons/bus/bustypes"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/fields"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
+)
+
+const (
+	// listenersChannelSuffix is appended to a channel name to get the channel on which its listeners changes are published
+	listenersChannelSuffix = "/listeners"
+	// listenersMessageType is the message type of the listeners changes
+	listenersMessageType = "bus.listeners"
+	// listenerTimeout is the duration after which a connection that has not polled a channel is not listening anymore
+	listenerTimeout = defaultTimeout + 10*time.Second
+	// listenerRefreshPeriod is the minimum duration between two writes of the last poll date of a listener
+	listenerRefreshPeriod = 10 * time.Second
+)
+
+/* Channel Listeners
+Keeps track of the connections that are currently polling the channels that have been
+registered with TrackChannelListeners. A connection is a device (i.e. a session) of a
+user, and it may have metadata on each channel, such as {"mode": "editing"}, that
+clients send in the 'bus_channel_metadata' poll option.
+
+Listeners are stored in the database so that they are shared by all workers. Connections
+join a channel when they first poll it, and leave it when they poll without it or when
+they have not polled for listenerTimeout. Changes are published on the channel's
+ListenersChannel.
+*/
+
+var fields_BusChannelListener = map[string]models.FieldDefinition{
+	"Channel": fields.Char{
+		Required: true,
+		Index:    true},
+
+	"User": fields.Many2One{
+		RelationModel: h.User(),
+		Required:      true,
+		OnDelete:      `cascade`},
+
+	"DeviceKey": fields.Char{
+		String: "Device",
+		Index:  true},
+
+	"Metadata": fields.Char{
+		Help: "JSON encoded metadata of the connection on this channel"},
+
+	"LastSeen": fields.DateTime{
+		Index: true},
+}
+
+// trackedChannels holds the channel prefixes whose listeners are tracked
+var trackedChannels struct {
+	sync.RWMutex
+	prefixes []string
+}
+
+// TrackChannelListeners enables the tracking of the listeners of all channels
+// starting with the given prefix.
+func TrackChannelListeners(prefix string) {
+	trackedChannels.Lock()
+	defer trackedChannels.Unlock()
+	trackedChannels.prefixes = append(trackedChannels.prefixes, prefix)
+}
+
+// isTrackedChannel returns true if the listeners of the given channel are tracked
+func isTrackedChannel(channel string) bool {
+	if strings.HasSuffix(channel, listenersChannelSuffix) {
+		return false
+	}
+	trackedChannels.RLock()
+	defer trackedChannels.RUnlock()
+	for _, prefix := range trackedChannels.prefixes {
+		if strings.HasPrefix(channel, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ListenersChannel returns the name of the bus channel on which the changes of the
+// listeners of the given channel are published.
+//
+// Messages have the form {type: 'bus.listeners', channel, joined: [], updated: [], left: []}
+// where joined, updated and left are lists of ChannelListener.
+func ListenersChannel(channel string) string {
+	return channel + listenersChannelSuffix
+}
+
+// listenersDiff holds the changes of the listeners of a channel
+type listenersDiff struct {
+	joined  []bustypes.ChannelListener
+	updated []bustypes.ChannelListener
+	left    []bustypes.ChannelListener
+}
+
+// listenersDiffs holds the listeners changes by channel
+type listenersDiffs map[string]*listenersDiff
+
+// get returns the diff of the given channel, creating it if needed
+func (ld listenersDiffs) get(channel string) *listenersDiff {
+	if ld[channel] == nil {
+		ld[channel] = new(listenersDiff)
+	}
+	return ld[channel]
+}
+
+// publish sends the diffs on the listeners channels
+func (ld listenersDiffs) publish(env models.Environment) {
+	if len(ld) == 0 {
+		return
+	}
+	var notifications []*bustypes.Notification
+	for channel, diff := range ld {
+		notifications = append(notifications, &bustypes.Notification{
+			Channel: ListenersChannel(channel),
+			Message: map[string]interface{}{
+				"type":    listenersMessageType,
+				"channel": channel,
+				"joined":  listenersOrEmpty(diff.joined),
+				"updated": listenersOrEmpty(diff.updated),
+				"left":    listenersOrEmpty(diff.left),
+			},
+			MessageType: listenersMessageType,
+		})
+	}
+	if err := h.BusBus().NewSet(env).SendmanyE(notifications); err != nil {
+		log.Warn("Unable to publish channel listeners changes", "error", err)
+	}
+}
+
+// listenersOrEmpty returns the given listeners, or an empty slice if nil,
+// so that it is marshalled as an empty JSON array.
+func listenersOrEmpty(listeners []bustypes.ChannelListener) []bustypes.ChannelListener {
+	if listeners == nil {
+		return []bustypes.ChannelListener{}
+	}
+	return listeners
+}
+
+// ToChannelListener returns the ChannelListener of this listener record
+func busChannelListener_ToChannelListener(rs m.BusChannelListenerSet) bustypes.ChannelListener {
+	rs.EnsureOne()
+	res := bustypes.ChannelListener{
+		ID:        rs.ID(),
+		UserID:    rs.User().ID(),
+		PartnerID: rs.User().Partner().ID(),
+	}
+	if rs.Metadata() != "" {
+		res.Metadata = json.RawMessage(rs.Metadata())
+	}
+	return res
+}
+
+// Track records that the current user is listening on the given channels from the device
+// with the given key, and is not listening anymore on the other channels.
+// metadata holds the JSON encoded metadata of the connection by channel.
+//
+// Only channels registered with TrackChannelListeners and that the current user may
+// poll are taken into account.
+func busChannelListener_Track(rs m.BusChannelListenerSet, deviceKey string, channels []string, metadata map[string]string) {
+	uid := rs.Env().Uid()
+	listening := make(map[string]bool)
+	for _, channel := range channels {
+		if isTrackedChannel(channel) && mayPollChannel(uid, channel) {
+			listening[channel] = true
+		}
+	}
+	now := presenceNow()
+	diffs := make(listenersDiffs)
+	existing := h.BusChannelListener().NewSet(rs.Env()).Sudo().Search(
+		q.BusChannelListener().User().Equals(h.User().BrowseOne(rs.Env(), uid)).
+			And().DeviceKey().Equals(deviceKey))
+	for _, listener := range existing.Records() {
+		channel := listener.Channel()
+		if !listening[channel] {
+			diffs.get(channel).left = append(diffs.get(channel).left, listener.ToChannelListener())
+			listener.Unlink()
+			continue
+		}
+		delete(listening, channel)
+		switch {
+		case listener.Metadata() != metadata[channel]:
+			listener.Write(h.BusChannelListener().NewData().
+				SetMetadata(metadata[channel]).
+				SetLastSeen(now))
+			diffs.get(channel).updated = append(diffs.get(channel).updated, listener.ToChannelListener())
+		case listener.LastSeen().Lower(now.Add(-listenerRefreshPeriod)):
+			listener.SetLastSeen(now)
+		}
+	}
+	for channel := range listening {
+		listener := h.BusChannelListener().NewSet(rs.Env()).Sudo().Create(h.BusChannelListener().NewData().
+			SetChannel(channel).
+			SetUser(h.User().BrowseOne(rs.Env(), uid)).
+			SetDeviceKey(deviceKey).
+			SetMetadata(metadata[channel]).
+			SetLastSeen(now))
+		diffs.get(channel).joined = append(diffs.get(channel).joined, listener.ToChannelListener())
+	}
+	diffs.publish(rs.Env())
+}
+
+// Expire removes the listeners that have not polled for listenerTimeout and
+// publishes that they left their channel.
+func busChannelListener_Expire(rs m.BusChannelListenerSet) {
+	expired := h.BusChannelListener().NewSet(rs.Env()).Sudo().Search(
+		q.BusChannelListener().LastSeen().Lower(presenceNow().Add(-listenerTimeout)))
+	if expired.IsEmpty() {
+		return
+	}
+	diffs := make(listenersDiffs)
+	for _, listener := range expired.Records() {
+		diff := diffs.get(listener.Channel())
+		diff.left = append(diff.left, listener.ToChannelListener())
+	}
+	expired.Unlink()
+	diffs.publish(rs.Env())
+}
+
+// Listeners returns the connections that are currently listening on the given channel.
+//
+// It panics if the current user may not poll this channel.
+func busChannelListener_Listeners(rs m.BusChannelListenerSet, channel string) []bustypes.ChannelListener {
+	if uid := rs.Env().Uid(); uid != security.SuperUserID && !mayPollChannel(uid, channel) {
+		panic(rs.T("You are not allowed to see the listeners of channel %s", channel))
+	}
+	listeners := h.BusChannelListener().NewSet(rs.Env()).Sudo().Search(
+		q.BusChannelListener().Channel().Equals(channel).
+			And().LastSeen().GreaterOrEqual(presenceNow().Add(-listenerTimeout))).OrderBy("ID")
+	res := []bustypes.ChannelListener{}
+	for _, listener := range listeners.Records() {
+		res = append(res, listener.ToChannelListener())
+	}
+	return res
+}
+
+// listenersMetadata returns the JSON encoded metadata by channel given in the poll options
+func listenersMetadata(options *types.Context) map[string]string {
+	res := make(map[string]string)
+	values, ok := options.Get("bus_channel_metadata").(map[string]interface{})
+	if !ok {
+		return res
+	}
+	for channel, value := range values {
+		if value == nil {
+			continue
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			continue
+		}
+		res[channel] = string(data)
+	}
+	return res
+}
+
+// trackListeners records the channels polled by the user with the given uid
+// with the given poll options.
+func trackListeners(uid int64, channels []string, options *types.Context) error {
+	deviceKey := options.GetString("bus_device_key")
+	if deviceKey == "" {
+		// Connections without device key cannot be told apart
+		return nil
+	}
+	return models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		h.BusChannelListener().NewSet(env).Track(deviceKey, channels, listenersMetadata(options))
+	})
+}
+
+// expireListeners removes the listeners that have stopped polling
+func expireListeners() {
+	models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		h.BusChannelListener().NewSet(env).Expire()
+	})
+}
+
+func init() {
+	models.NewModel("BusChannelListener")
+	h.BusChannelListener().AddFields(fields_BusChannelListener)
+	h.BusChannelListener().NewMethod("ToChannelListener", busChannelListener_ToChannelListener)
+	h.BusChannelListener().NewMethod("Track", busChannelListener_Track)
+	h.BusChannelListener().NewMethod("Expire", busChannelListener_Expire)
+	h.BusChannelListener().NewMethod("Listeners", busChannelListener_Listeners)
+	h.BusChannelListener().AddSQLConstraint("channel_user_device_uniq", "unique(channel, user_id, device_key)",
+		"A device of a user can only listen once on a channel")
+
+	models.RegisterWorker(models.NewWorkerFunction(expireListeners, presenceSweepPeriod))
+}
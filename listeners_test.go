@@ -0,0 +1,129 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hexya-addons/bus/bustypes"
+	"github.com/hexya-addons/web/client"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/q"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestChannelListeners(t *testing.T) {
+	cl1 := newTestClient()
+	cl2 := newTestClient()
+	Convey("Testing channel listeners", t, func() {
+		TrackChannelListeners("listeners.")
+		models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			// Changes are published in their own transaction, so the listening user must be committed
+			user := h.User().Search(env, q.User().Login().Equals("admin"))
+			userListeners := h.BusChannelListener().NewSet(env).Sudo(user.ID())
+			// Notifications are committed, so we ignore the ones sent by previous runs
+			var start int64
+			for _, notif := range h.BusBus().NewSet(env).Poll([]string{ListenersChannel("listeners.record.1")}, 0, types.NewContext(), false) {
+				if notif.ID > start {
+					start = notif.ID
+				}
+			}
+			listenersMessages := func(channel string) []map[string]interface{} {
+				var res []map[string]interface{}
+				notifs := h.BusBus().NewSet(env).Poll([]string{ListenersChannel(channel)}, start, types.NewContext(), false)
+				for _, notif := range notifs {
+					res = append(res, notif.Message.(map[string]interface{}))
+				}
+				return res
+			}
+			Convey("Only tracked channels are recorded", func() {
+				userListeners.Track("device1", []string{"listeners.record.1", "other"}, nil)
+				So(h.BusChannelListener().NewSet(env).Listeners("listeners.record.1"), ShouldHaveLength, 1)
+				So(h.BusChannelListener().NewSet(env).Listeners("other"), ShouldBeEmpty)
+				So(isTrackedChannel(ListenersChannel("listeners.record.1")), ShouldBeFalse)
+			})
+			Convey("Joins, metadata updates and leaves are published", func() {
+				userListeners.Track("device1", []string{"listeners.record.1"}, nil)
+				userListeners.Track("device2", []string{"listeners.record.1"}, map[string]string{"listeners.record.1": `{"mode":"viewing"}`})
+				listeners := h.BusChannelListener().NewSet(env).Listeners("listeners.record.1")
+				So(listeners, ShouldHaveLength, 2)
+				So(listeners[0].UserID, ShouldEqual, user.ID())
+				So(listeners[0].PartnerID, ShouldEqual, user.Partner().ID())
+				So(string(listeners[1].Metadata), ShouldEqual, `{"mode":"viewing"}`)
+				So(listenersMessages("listeners.record.1"), ShouldHaveLength, 2)
+
+				userListeners.Track("device2", []string{"listeners.record.1"}, map[string]string{"listeners.record.1": `{"mode":"editing"}`})
+				messages := listenersMessages("listeners.record.1")
+				So(messages, ShouldHaveLength, 3)
+				So(messages[2]["updated"], ShouldHaveLength, 1)
+
+				userListeners.Track("device1", []string{"listeners.record.2"}, nil)
+				messages = listenersMessages("listeners.record.1")
+				So(messages, ShouldHaveLength, 4)
+				So(messages[3]["left"], ShouldHaveLength, 1)
+				So(h.BusChannelListener().NewSet(env).Listeners("listeners.record.1"), ShouldHaveLength, 1)
+				So(h.BusChannelListener().NewSet(env).Listeners("listeners.record.2"), ShouldHaveLength, 1)
+			})
+			Convey("Users only listen on and list the channels they may poll", func() {
+				TrackChannelListeners(userChannelPrefix)
+				own, other := UserChannel(user.ID()), UserChannel(user.ID()+1000)
+				userListeners.Track("device1", []string{own, other}, nil)
+				So(h.BusChannelListener().NewSet(env).Listeners(own), ShouldHaveLength, 1)
+				So(h.BusChannelListener().NewSet(env).Listeners(other), ShouldBeEmpty)
+				viewer := h.User().Create(env, h.User().NewData().SetName("Listeners Viewer").SetLogin("listeners_viewer"))
+				So(func() { h.BusChannelListener().NewSet(env).Sudo(viewer.ID()).Listeners(own) }, ShouldPanic)
+				So(h.BusChannelListener().NewSet(env).Sudo(viewer.ID()).Listeners("listeners.record.1"), ShouldBeEmpty)
+			})
+			Convey("Connections that stopped polling expire", func() {
+				userListeners.Track("device1", []string{"listeners.record.1"}, nil)
+				h.BusChannelListener().Search(env, q.BusChannelListener().Channel().Equals("listeners.record.1")).
+					SetLastSeen(dates.Now().Add(-2 * listenerTimeout))
+				So(h.BusChannelListener().NewSet(env).Listeners("listeners.record.1"), ShouldBeEmpty)
+				h.BusChannelListener().NewSet(env).Expire()
+				So(h.BusChannelListener().Search(env, q.BusChannelListener().Channel().Equals("listeners.record.1")).IsEmpty(), ShouldBeTrue)
+				messages := listenersMessages("listeners.record.1")
+				So(messages[len(messages)-1]["left"], ShouldHaveLength, 1)
+			})
+		})
+		Convey("Connections of a user on different channels do not evict each other", func() {
+			TrackChannelListeners("listeners.keys.")
+			channelA := fmt.Sprintf("listeners.keys.%d.a", time.Now().UnixNano())
+			channelB := fmt.Sprintf("listeners.keys.%d.b", time.Now().UnixNano())
+			for _, poll := range []struct {
+				cl      *client.Hexya
+				channel string
+			}{{cl1, channelA}, {cl2, channelB}, {cl1, channelA}} {
+				_, err := poll.cl.RPC("/longpolling/poll", "call", bustypes.PollParams{
+					Channels: []string{poll.channel},
+					Options:  types.NewContext().WithKey("timeout", 0),
+				})
+				So(err, ShouldBeNil)
+			}
+			models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+				listeners := h.BusChannelListener().NewSet(env)
+				So(listeners.Listeners(channelA), ShouldHaveLength, 1)
+				So(listeners.Listeners(channelB), ShouldHaveLength, 1)
+				var changes int
+				for _, notif := range h.BusBus().NewSet(env).Poll([]string{ListenersChannel(channelA)}, 0, types.NewContext(), false) {
+					if notif.MessageType == listenersMessageType {
+						changes++
+					}
+				}
+				// Only the join of the first connection
+				So(changes, ShouldEqual, 1)
+			})
+		})
+		Reset(func() {
+			trackedChannels.Lock()
+			trackedChannels.prefixes = nil
+			trackedChannels.Unlock()
+		})
+	})
+}
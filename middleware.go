@@ -0,0 +1,104 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/hexya-addons/bus/bustypes"
+	"github.com/hexya-erp/hexya/src/models"
+)
+
+// A SendMiddleware processes a notification before it is stored on the bus.
+//
+// It returns the notifications to send in place of the given one, so that it can
+// modify it, drop it by returning an empty slice, or fan it out by returning several
+// notifications. Returning an error aborts the whole sending.
+type SendMiddleware func(env models.Environment, notification *bustypes.Notification) ([]*bustypes.Notification, error)
+
+// A PollMiddleware processes a notification before it is returned to a polling client.
+//
+// The given environment is the one of the polling user. It returns the notifications
+// to deliver in place of the given one, so that it can modify it, drop it by returning
+// an empty slice, or fan it out by returning several notifications.
+type PollMiddleware func(env models.Environment, notification *bustypes.Notification) []*bustypes.Notification
+
+type sendMiddlewareEntry struct {
+	sequence int
+	fnct     SendMiddleware
+}
+
+type pollMiddlewareEntry struct {
+	sequence int
+	fnct     PollMiddleware
+}
+
+// middlewares holds the registered middlewares, sorted by sequence
+var middlewares struct {
+	sync.RWMutex
+	send []sendMiddlewareEntry
+	poll []pollMiddlewareEntry
+}
+
+// RegisterSendMiddleware adds the given middleware to the chain run on Sendmany.
+// Middlewares are run by increasing sequence, then by order of registration.
+func RegisterSendMiddleware(sequence int, mw SendMiddleware) {
+	middlewares.Lock()
+	defer middlewares.Unlock()
+	middlewares.send = append(middlewares.send, sendMiddlewareEntry{sequence: sequence, fnct: mw})
+	sort.SliceStable(middlewares.send, func(i, j int) bool {
+		return middlewares.send[i].sequence < middlewares.send[j].sequence
+	})
+}
+
+// RegisterPollMiddleware adds the given middleware to the chain run on poll results.
+// Middlewares are run by increasing sequence, then by order of registration.
+func RegisterPollMiddleware(sequence int, mw PollMiddleware) {
+	middlewares.Lock()
+	defer middlewares.Unlock()
+	middlewares.poll = append(middlewares.poll, pollMiddlewareEntry{sequence: sequence, fnct: mw})
+	sort.SliceStable(middlewares.poll, func(i, j int) bool {
+		return middlewares.poll[i].sequence < middlewares.poll[j].sequence
+	})
+}
+
+// applySendMiddlewares runs the send middleware chain on the given notifications.
+func applySendMiddlewares(env models.Environment, notifications []*bustypes.Notification) ([]*bustypes.Notification, error) {
+	middlewares.RLock()
+	defer middlewares.RUnlock()
+	for _, mw := range middlewares.send {
+		var res []*bustypes.Notification
+		for _, notif := range notifications {
+			out, err := mw.fnct(env, notif)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, out...)
+		}
+		notifications = res
+	}
+	return notifications, nil
+}
+
+// applyPollMiddlewares runs the poll middleware chain on the given notifications.
+func applyPollMiddlewares(env models.Environment, notifications []*bustypes.Notification) []*bustypes.Notification {
+	middlewares.RLock()
+	defer middlewares.RUnlock()
+	for _, mw := range middlewares.poll {
+		var res []*bustypes.Notification
+		for _, notif := range notifications {
+			res = append(res, mw.fnct(env, notif)...)
+		}
+		notifications = res
+	}
+	return notifications
+}
+
+// hasPollMiddlewares returns true if at least one poll middleware is registered
+func hasPollMiddlewares() bool {
+	middlewares.RLock()
+	defer middlewares.RUnlock()
+	return len(middlewares.poll) > 0
+}
@@ -0,0 +1,104 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hexya-addons/bus/bustypes"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/pool/h"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMiddlewares(t *testing.T) {
+	Convey("Testing notification middlewares", t, func() {
+		middlewares.RLock()
+		sendMiddlewares, pollMiddlewares := middlewares.send, middlewares.poll
+		middlewares.RUnlock()
+		RegisterSendMiddleware(20, func(env models.Environment, notif *bustypes.Notification) ([]*bustypes.Notification, error) {
+			switch notif.Channel {
+			case "mw.spam":
+				return nil, nil
+			case "mw.fanout":
+				return []*bustypes.Notification{
+					{Channel: "mw.fanout.1", Message: notif.Message},
+					{Channel: "mw.fanout.2", Message: notif.Message},
+				}, nil
+			case "mw.error":
+				return nil, errors.New("middleware error")
+			}
+			return []*bustypes.Notification{notif}, nil
+		})
+		RegisterSendMiddleware(10, func(env models.Environment, notif *bustypes.Notification) ([]*bustypes.Notification, error) {
+			if notif.Channel == "mw.legacy" {
+				notif.Channel = "mw.fanout"
+			}
+			return []*bustypes.Notification{notif}, nil
+		})
+		RegisterPollMiddleware(10, func(env models.Environment, notif *bustypes.Notification) []*bustypes.Notification {
+			if notif.Channel == "mw.redacted" {
+				notif.Message = "redacted"
+			}
+			return []*bustypes.Notification{notif}
+		})
+		Convey("Send middlewares can modify, drop and fan out notifications in sequence order", func() {
+			res, err := applySendMiddlewares(models.Environment{}, []*bustypes.Notification{
+				{Channel: "mw.spam", Message: "spam"},
+				{Channel: "mw.legacy", Message: "legacy"},
+				{Channel: "mw.other", Message: "other"},
+			})
+			So(err, ShouldBeNil)
+			So(res, ShouldHaveLength, 3)
+			So(res[0].Channel, ShouldEqual, "mw.fanout.1")
+			So(res[1].Channel, ShouldEqual, "mw.fanout.2")
+			So(res[1].Message, ShouldEqual, "legacy")
+			So(res[2].Channel, ShouldEqual, "mw.other")
+		})
+		Convey("Send middleware errors abort the sending", func() {
+			_, err := applySendMiddlewares(models.Environment{}, []*bustypes.Notification{
+				{Channel: "mw.other", Message: "other"},
+				{Channel: "mw.error", Message: "error"},
+			})
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Poll middlewares are applied on poll results", func() {
+			res := applyPollMiddlewares(models.Environment{}, []*bustypes.Notification{
+				{Channel: "mw.redacted", Message: "secret"},
+				{Channel: "mw.other", Message: "other"},
+			})
+			So(res, ShouldHaveLength, 2)
+			So(res[0].Message, ShouldEqual, "redacted")
+			So(res[1].Message, ShouldEqual, "other")
+		})
+		Convey("Polls whose notifications are all dropped wait for the next ones", func() {
+			RegisterPollMiddleware(10, func(env models.Environment, notif *bustypes.Notification) []*bustypes.Notification {
+				if notif.Channel == "mw.dropped" {
+					return nil
+				}
+				return []*bustypes.Notification{notif}
+			})
+			dropped := &bustypes.Notification{Channel: "mw.dropped", Message: "dropped"}
+			models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+				So(h.BusBus().NewSet(env).SendmanyE([]*bustypes.Notification{dropped}), ShouldBeNil)
+			})
+			start := time.Now()
+			res, err := newBusDispatcher().PollE(security.SuperUserID, []string{"mw.dropped"}, dropped.ID-1,
+				types.NewContext().WithKey("timeout", 1))
+			So(err, ShouldBeNil)
+			So(res, ShouldBeEmpty)
+			So(time.Since(start), ShouldBeGreaterThanOrEqualTo, time.Second)
+		})
+		Reset(func() {
+			middlewares.Lock()
+			middlewares.send = sendMiddlewares
+			middlewares.poll = pollMiddlewares
+			middlewares.Unlock()
+		})
+	})
+}
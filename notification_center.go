@@ -0,0 +1,283 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hexya-addons/bus/bustypes"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/fields"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
+)
+
+const (
+	// userNotificationMessageType is the message type of the notification center
+	// notifications pushed on the user channel
+	userNotificationMessageType = "bus.user_notification"
+	// unreadCounterMessageType is the message type of the unread counters
+	unreadCounterMessageType = "bus.unread_counter"
+	// unreadCounterChannelPrefix is the prefix of the users' unread counter channels
+	unreadCounterChannelPrefix = "bus.unread_counter."
+	// userNotificationRetention is the duration after which read notifications are removed
+	userNotificationRetention = 30 * 24 * time.Hour
+)
+
+/* Notification Center
+The notification center stores the user-facing notifications of each user (e.g. to
+be shown under a bell icon), with a title, a body, a severity and an optional link
+to a record or a window action.
+
+Addons send them with NotifyUser (or the users' Notify method), which stores them and
+pushes them on the UserChannel of the users as {type: 'bus.user_notification',
+notification: UserNotification}. Each change of the number of unread notifications of
+a user is published on its UnreadCounterChannel as {type: 'bus.unread_counter',
+unread: <count>}.
+
+Read notifications are removed after userNotificationRetention.
+*/
+
+// userNotificationSeverities are the possible values of the Severity field
+var userNotificationSeverities = types.Selection{
+	"info":    "Info",
+	"success": "Success",
+	"warning": "Warning",
+	"danger":  "Danger",
+}
+
+var fields_BusUserNotification = map[string]models.FieldDefinition{
+	"User": fields.Many2One{
+		RelationModel: h.User(),
+		Required:      true,
+		Index:         true,
+		OnDelete:      `cascade`},
+
+	"Title": fields.Char{
+		Required: true},
+
+	"Body": fields.Text{},
+
+	"Severity": fields.Selection{
+		Selection: userNotificationSeverities,
+		Required:  true,
+		Default:   models.DefaultValue("info")},
+
+	"ResModel": fields.Char{
+		String: "Related Model",
+		Help:   "Model of the record this notification links to"},
+
+	"ResID": fields.Integer{
+		String: "Related Record ID",
+		Help:   "ID of the record this notification links to"},
+
+	"Action": fields.Char{
+		Help: "ID of the window action this notification links to"},
+
+	"Read": fields.Boolean{
+		Index: true},
+
+	"ReadDate": fields.DateTime{
+		String: "Read On"},
+}
+
+// UnreadCounterChannel returns the name of the bus channel on which the number of
+// unread notifications of the user with the given ID is published.
+func UnreadCounterChannel(uid int64) string {
+	return fmt.Sprintf("%s%d", unreadCounterChannelPrefix, uid)
+}
+
+// NotifyUser adds the given notification to the notification center of each of the
+// given users and pushes it to their clients. It returns the created records.
+//
+// The ID, Read and CreateDate fields of notification are ignored. Severity defaults to 'info'.
+func NotifyUser(users m.UserSet, notification bustypes.UserNotification) m.BusUserNotificationSet {
+	return users.Notify(notification)
+}
+
+// ToUserNotification returns the UserNotification of this notification record
+func busUserNotification_ToUserNotification(rs m.BusUserNotificationSet) bustypes.UserNotification {
+	rs.EnsureOne()
+	return bustypes.UserNotification{
+		ID:         rs.ID(),
+		Title:      rs.Title(),
+		Body:       rs.Body(),
+		Severity:   rs.Severity(),
+		ResModel:   rs.ResModel(),
+		ResID:      rs.ResID(),
+		Action:     rs.Action(),
+		Read:       rs.Read(),
+		CreateDate: rs.CreateDate(),
+	}
+}
+
+// MarkRead marks these notifications as read and publishes the new unread
+// counters of their users.
+func busUserNotification_MarkRead(rs m.BusUserNotificationSet) {
+	if rs.IsEmpty() {
+		return
+	}
+	unread := h.BusUserNotification().NewSet(rs.Env()).Sudo().Search(
+		q.BusUserNotification().ID().In(rs.Ids()).And().Read().Equals(false))
+	if unread.IsEmpty() {
+		return
+	}
+	users := h.User().NewSet(rs.Env())
+	for _, notification := range unread.Records() {
+		users = users.Union(notification.User())
+	}
+	unread.Write(h.BusUserNotification().NewData().
+		SetRead(true).
+		SetReadDate(dates.Now()))
+	publishUnreadCounters(users)
+}
+
+// Gc removes the notifications that have been read for userNotificationRetention.
+func busUserNotification_Gc(rs m.BusUserNotificationSet) int64 {
+	limit := dates.Now().Add(-userNotificationRetention)
+	return h.BusUserNotification().NewSet(rs.Env()).Sudo().Search(
+		q.BusUserNotification().Read().Equals(true).And().ReadDate().Lower(limit)).Unlink()
+}
+
+// Notify adds the given notification to the notification center of each user of this
+// recordset and pushes it to their clients. It returns the created records.
+//
+// The ID, Read and CreateDate fields of notification are ignored. Severity defaults to 'info'.
+func user_Notify(rs m.UserSet, notification bustypes.UserNotification) m.BusUserNotificationSet {
+	if notification.Severity == "" {
+		notification.Severity = "info"
+	}
+	if _, ok := userNotificationSeverities[notification.Severity]; !ok {
+		panic(rs.T("Unknown notification severity: %s", notification.Severity))
+	}
+	res := h.BusUserNotification().NewSet(rs.Env())
+	var pushes []*bustypes.Notification
+	for _, user := range rs.Records() {
+		record := h.BusUserNotification().NewSet(rs.Env()).Sudo().Create(
+			h.BusUserNotification().NewData().
+				SetUser(user).
+				SetTitle(notification.Title).
+				SetBody(notification.Body).
+				SetSeverity(notification.Severity).
+				SetResModel(notification.ResModel).
+				SetResID(notification.ResID).
+				SetAction(notification.Action))
+		res = res.Union(record)
+		pushes = append(pushes, &bustypes.Notification{
+			Channel: UserChannel(user.ID()),
+			Message: map[string]interface{}{
+				"type":         userNotificationMessageType,
+				"notification": record.ToUserNotification(),
+			},
+			MessageType: userNotificationMessageType,
+		})
+	}
+	if len(pushes) > 0 {
+		if err := h.BusBus().NewSet(rs.Env()).SendmanyE(pushes); err != nil {
+			log.Warn("Unable to push user notifications", "error", err)
+		}
+	}
+	publishUnreadCounters(rs)
+	return res
+}
+
+// Notifications returns the notification center notifications of this user
+// matching the given parameters, most recent first.
+func user_Notifications(rs m.UserSet, params bustypes.UserNotificationsParams) []bustypes.UserNotification {
+	rs.EnsureOne()
+	cond := q.BusUserNotification().User().Equals(rs)
+	if params.UnreadOnly {
+		cond = cond.And().Read().Equals(false)
+	}
+	notifications := h.BusUserNotification().NewSet(rs.Env()).Sudo().Search(cond).OrderBy("ID desc")
+	if params.Offset > 0 {
+		notifications = notifications.Offset(params.Offset)
+	}
+	if params.Limit > 0 {
+		notifications = notifications.Limit(params.Limit)
+	}
+	res := []bustypes.UserNotification{}
+	for _, notification := range notifications.Records() {
+		res = append(res, notification.ToUserNotification())
+	}
+	return res
+}
+
+// MarkNotificationsRead marks the notifications of this user with the given IDs as read.
+// IDs of notifications of other users are ignored.
+func user_MarkNotificationsRead(rs m.UserSet, ids []int64) {
+	rs.EnsureOne()
+	if len(ids) == 0 {
+		return
+	}
+	h.BusUserNotification().NewSet(rs.Env()).Sudo().Search(
+		q.BusUserNotification().User().Equals(rs).And().ID().In(ids)).MarkRead()
+}
+
+// MarkAllNotificationsRead marks all the notifications of the users of this recordset as read.
+func user_MarkAllNotificationsRead(rs m.UserSet) {
+	if rs.IsEmpty() {
+		return
+	}
+	h.BusUserNotification().NewSet(rs.Env()).Sudo().Search(
+		q.BusUserNotification().User().In(rs)).MarkRead()
+}
+
+// UnreadNotificationCounts returns the number of unread notifications of the
+// users of this recordset, by user ID.
+func user_UnreadNotificationCounts(rs m.UserSet) map[int64]int64 {
+	res := make(map[int64]int64)
+	if rs.IsEmpty() {
+		return res
+	}
+	for _, id := range rs.Ids() {
+		res[id] = 0
+	}
+	unread := h.BusUserNotification().NewSet(rs.Env()).Sudo().Search(
+		q.BusUserNotification().User().In(rs).And().Read().Equals(false))
+	for _, notification := range unread.Records() {
+		res[notification.User().ID()]++
+	}
+	return res
+}
+
+// publishUnreadCounters publishes the number of unread notifications of the given
+// users on their UnreadCounterChannel.
+func publishUnreadCounters(users m.UserSet) {
+	if users.IsEmpty() {
+		return
+	}
+	var notifications []*bustypes.Notification
+	for uid, count := range users.UnreadNotificationCounts() {
+		notifications = append(notifications, &bustypes.Notification{
+			Channel: UnreadCounterChannel(uid),
+			Message: map[string]interface{}{
+				"type":   unreadCounterMessageType,
+				"unread": count,
+			},
+			MessageType: unreadCounterMessageType,
+		})
+	}
+	if err := h.BusBus().NewSet(users.Env()).SendmanyE(notifications); err != nil {
+		log.Warn("Unable to publish unread counters", "error", err)
+	}
+}
+
+func init() {
+	models.NewModel("BusUserNotification")
+	h.BusUserNotification().AddFields(fields_BusUserNotification)
+	h.BusUserNotification().NewMethod("ToUserNotification", busUserNotification_ToUserNotification)
+	h.BusUserNotification().NewMethod("MarkRead", busUserNotification_MarkRead)
+	h.BusUserNotification().NewMethod("Gc", busUserNotification_Gc)
+
+	h.User().NewMethod("Notify", user_Notify)
+	h.User().NewMethod("Notifications", user_Notifications)
+	h.User().NewMethod("MarkNotificationsRead", user_MarkNotificationsRead)
+	h.User().NewMethod("MarkAllNotificationsRead", user_MarkAllNotificationsRead)
+	h.User().NewMethod("UnreadNotificationCounts", user_UnreadNotificationCounts)
+}
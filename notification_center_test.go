@@ -0,0 +1,77 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"testing"
+
+	"github.com/hexya-addons/bus/bustypes"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/q"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNotificationCenter(t *testing.T) {
+	Convey("Testing the notification center", t, func() {
+		models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			user := h.User().Search(env, q.User().Login().Equals("admin"))
+			lastCounter := func() float64 {
+				notifs := h.BusBus().NewSet(env).Poll([]string{UnreadCounterChannel(user.ID())}, 0, types.NewContext(), false)
+				So(notifs, ShouldNotBeEmpty)
+				return notifs[len(notifs)-1].Message.(map[string]interface{})["unread"].(float64)
+			}
+			first := NotifyUser(user, bustypes.UserNotification{
+				Title:    "Invoice validated",
+				ResModel: "AccountInvoice",
+				ResID:    12,
+			})
+			second := NotifyUser(user, bustypes.UserNotification{
+				Title:    "Backup failed",
+				Body:     "Disk full",
+				Severity: "danger",
+			})
+			So(first.Severity(), ShouldEqual, "info")
+			So(second.Severity(), ShouldEqual, "danger")
+			So(user.UnreadNotificationCounts()[user.ID()], ShouldEqual, 2)
+			So(lastCounter(), ShouldEqual, 2)
+			Convey("Notifications are listed most recent first", func() {
+				notifs := user.Notifications(bustypes.UserNotificationsParams{})
+				So(notifs, ShouldHaveLength, 2)
+				So(notifs[0].ID, ShouldEqual, second.ID())
+				So(notifs[1].ResModel, ShouldEqual, "AccountInvoice")
+				So(user.Notifications(bustypes.UserNotificationsParams{Limit: 1, Offset: 1}), ShouldHaveLength, 1)
+			})
+			Convey("Notifications are pushed on the user channel", func() {
+				var pushed int
+				for _, notif := range h.BusBus().NewSet(env).Poll([]string{UserChannel(user.ID())}, 0, types.NewContext(), false) {
+					if notif.MessageType == userNotificationMessageType {
+						pushed++
+					}
+				}
+				So(pushed, ShouldBeGreaterThanOrEqualTo, 2)
+			})
+			Convey("Marking read updates the unread counter", func() {
+				user.MarkNotificationsRead([]int64{first.ID()})
+				So(first.Read(), ShouldBeTrue)
+				So(first.ReadDate().IsZero(), ShouldBeFalse)
+				So(user.UnreadNotificationCounts()[user.ID()], ShouldEqual, 1)
+				So(user.Notifications(bustypes.UserNotificationsParams{UnreadOnly: true}), ShouldHaveLength, 1)
+				So(lastCounter(), ShouldEqual, 1)
+				user.MarkAllNotificationsRead()
+				So(user.UnreadNotificationCounts()[user.ID()], ShouldEqual, 0)
+				So(lastCounter(), ShouldEqual, 0)
+			})
+			Convey("Other users' notifications cannot be marked read", func() {
+				h.User().BrowseOne(env, security.SuperUserID).MarkNotificationsRead([]int64{first.ID()})
+				So(first.Read(), ShouldBeFalse)
+			})
+			Convey("Unknown severities are rejected", func() {
+				So(func() { NotifyUser(user, bustypes.UserNotification{Title: "Oops", Severity: "fatal"}) }, ShouldPanic)
+			})
+		})
+	})
+}
@@ -1,7 +1,9 @@
 package bus
 
 import (
-	"time"
+	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/hexya-addons/bus/bustypes"
 	"github.com/hexya-erp/hexya/src/models"
@@ -18,37 +20,201 @@ var fields_Partner = map[string]models.FieldDefinition{
 
 // ComputeIMStatus computes the IM status of the partner
 func partner_ComputeIMStatus(rs m.PartnerSet) m.PartnerData {
-	presence := h.BusPresence().Search(rs.Env(), q.BusPresence().UserFilteredOn(q.User().Partner().Equals(rs))).Limit(1)
-	res := h.Partner().NewData().SetIMStatus("offline")
-	switch {
-	case time.Since(presence.LastPoll().Time) > disconnectionTimer:
-		res.SetIMStatus("offline")
-	case time.Since(presence.LastPresence().Time) > awayTimer:
-		res.SetIMStatus("away")
-	default:
-		res.SetIMStatus("online")
+	return h.Partner().NewData().SetIMStatus(rs.IMStatuses()[rs.ID()])
+}
+
+// IMStatuses returns the IM status of each partner of this recordset, by partner ID.
+//
+// The status of a partner with several users is the most available status of its users
+// whose presence can be seen by the current user and of its guests, such as bots.
+// Use this method instead of reading IMStatus on each record when dealing with several partners.
+func partner_IMStatuses(rs m.PartnerSet) map[int64]string {
+	res := make(map[int64]string)
+	for _, id := range rs.Ids() {
+		res[id] = "offline"
+	}
+	if rs.IsEmpty() {
+		return res
+	}
+	users := h.User().NewSet(rs.Env()).Sudo().Search(q.User().Partner().In(rs)).Load(q.User().Partner())
+	partners := make(map[int64]int64)
+	for _, user := range users.Records() {
+		partners[user.ID()] = user.Partner().ID()
+	}
+	visible := visibleUsers(rs.Env(), users)
+	for userID, status := range usersStatuses(users) {
+		if !visible[userID] {
+			continue
+		}
+		partnerID := partners[userID]
+		res[partnerID] = bestStatus(res[partnerID], status)
+	}
+	for partnerID, status := range partnersGuestsStatuses(rs) {
+		res[partnerID] = bestStatus(res[partnerID], status)
+	}
+	return res
+}
+
+// IMStatusMessages returns the status message of each partner of this recordset, by partner ID.
+//
+// The status message of a partner with several users is the one of its first user having one.
+func partner_IMStatusMessages(rs m.PartnerSet) map[int64]string {
+	res := make(map[int64]string)
+	if rs.IsEmpty() {
+		return res
+	}
+	users := h.User().NewSet(rs.Env()).Sudo().Search(q.User().Partner().In(rs)).OrderBy("ID").Load(q.User().Partner())
+	messages := users.Sudo(rs.Env().Uid()).IMStatusMessages()
+	for _, user := range users.Records() {
+		partnerID := user.Partner().ID()
+		if _, exists := res[partnerID]; !exists && messages[user.ID()] != "" {
+			res[partnerID] = messages[user.ID()]
+		}
 	}
 	return res
 }
 
-// IMSearch search partner with a name and return its id, name and im_status.
-// Note : the user must be logged
-// - name : the partner name to search
-// - limit : the limit of result to return
+// imPartnerStatus is the IM status of the partners that have no user
+const imPartnerStatus = "im_partner"
+
+// partnerAvatarURL returns the URL of the avatar of the partner with the given ID
+func partnerAvatarURL(partnerID int64) string {
+	return fmt.Sprintf("/web/image/res.partner/%d/image_small", partnerID)
+}
+
+// IMSearch searches the users other than the current one whose name matches the given
+// name and returns at most limit of them, ordered by name, with their IM status.
+//
+// Deprecated: use SearchIMContacts which also matches emails and logins, orders the results
+// by status and supports pagination and filters.
 func partner_IMSearch(rs m.PartnerSet, name string, limit int) []bustypes.IMSearchResult {
-	users := h.User().Search(rs.Env(), q.User().Name().ILike(name).And().ID().NotEquals(rs.Env().Uid())).Limit(limit)
+	users := h.User().Search(rs.Env(), q.User().Name().ILike(name).And().ID().NotEquals(rs.Env().Uid())).
+		OrderBy("Name", "ID")
+	if limit > 0 {
+		users = users.Limit(limit)
+	}
+	statuses := users.IMStatuses()
 	var res []bustypes.IMSearchResult
 	for _, user := range users.Records() {
 		res = append(res, bustypes.IMSearchResult{
-			ID:       user.Partner().ID(),
-			Name:     user.Name(),
-			IMStatus: user.IMStatus(),
+			ID:        user.Partner().ID(),
+			UserID:    user.ID(),
+			Name:      user.Name(),
+			IMStatus:  statuses[user.ID()],
+			AvatarURL: partnerAvatarURL(user.Partner().ID()),
 		})
 	}
 	return res
 }
+
+// SearchIMContacts searches the users other than the current one whose name, email or login
+// matches the given params' name and returns them with their IM status.
+//
+// Results are filtered by status, company and group and are paginated with the params'
+// offset and limit. A zero limit returns all results.
+//
+// Results are ordered by status, most available first, then by name. Without status filter
+// and partners, pagination is done by the database on the users ordered by name, so that
+// the status order only applies within a page.
+//
+// If params.IncludePartners is true, matching partners without user are returned too
+// with the 'im_partner' status. They are excluded when filtering by group.
+func partner_SearchIMContacts(rs m.PartnerSet, params bustypes.IMSearchParams) []bustypes.IMSearchResult {
+	if params.Offset < 0 {
+		params.Offset = 0
+	}
+	if params.Limit < 0 {
+		params.Limit = 0
+	}
+	userCond := q.User().ID().NotEquals(rs.Env().Uid()).
+		AndCond(q.User().Name().ILike(params.Name).
+			Or().Email().ILike(params.Name).
+			Or().Login().ILike(params.Name))
+	if len(params.CompanyIDs) > 0 {
+		userCond = userCond.And().Companies().In(h.Company().Browse(rs.Env(), params.CompanyIDs))
+	}
+	if len(params.GroupIDs) > 0 {
+		userCond = userCond.And().Groups().In(h.Group().Browse(rs.Env(), params.GroupIDs))
+	}
+	users := h.User().Search(rs.Env(), userCond)
+	dbPaginated := len(params.Statuses) == 0 && !params.IncludePartners
+	if dbPaginated {
+		users = users.OrderBy("Name", "ID").Offset(params.Offset)
+		if params.Limit > 0 {
+			users = users.Limit(params.Limit)
+		}
+	}
+	statuses := users.IMStatuses()
+	messages := users.IMStatusMessages()
+	wanted := make(map[string]bool)
+	for _, status := range params.Statuses {
+		wanted[status] = true
+	}
+	res := []bustypes.IMSearchResult{}
+	for _, user := range users.Records() {
+		status := statuses[user.ID()]
+		if len(wanted) > 0 && !wanted[status] {
+			continue
+		}
+		res = append(res, bustypes.IMSearchResult{
+			ID:            user.Partner().ID(),
+			UserID:        user.ID(),
+			Name:          user.Name(),
+			IMStatus:      status,
+			StatusMessage: messages[user.ID()],
+			AvatarURL:     partnerAvatarURL(user.Partner().ID()),
+		})
+	}
+	if params.IncludePartners && len(params.GroupIDs) == 0 && (len(wanted) == 0 || wanted[imPartnerStatus]) {
+		partnerCond := q.Partner().Name().ILike(params.Name).Or().Email().ILike(params.Name)
+		if len(params.CompanyIDs) > 0 {
+			partnerCond = q.Partner().Company().In(h.Company().Browse(rs.Env(), params.CompanyIDs)).AndCond(partnerCond)
+		}
+		partners := h.Partner().Search(rs.Env(), partnerCond)
+		withUser := make(map[int64]bool)
+		for _, user := range h.User().NewSet(rs.Env()).Sudo().Search(q.User().Partner().In(partners)).Load(q.User().Partner()).Records() {
+			withUser[user.Partner().ID()] = true
+		}
+		for _, partner := range partners.Records() {
+			if withUser[partner.ID()] {
+				continue
+			}
+			res = append(res, bustypes.IMSearchResult{
+				ID:        partner.ID(),
+				Name:      partner.Name(),
+				IMStatus:  imPartnerStatus,
+				AvatarURL: partnerAvatarURL(partner.ID()),
+			})
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		ri, rj := statusRanks[res[i].IMStatus], statusRanks[res[j].IMStatus]
+		if ri != rj {
+			return ri > rj
+		}
+		if res[i].Name != res[j].Name {
+			return strings.ToLower(res[i].Name) < strings.ToLower(res[j].Name)
+		}
+		return res[i].ID < res[j].ID
+	})
+	if dbPaginated {
+		return res
+	}
+	if params.Offset >= len(res) {
+		return []bustypes.IMSearchResult{}
+	}
+	res = res[params.Offset:]
+	if params.Limit > 0 && params.Limit < len(res) {
+		res = res[:params.Limit]
+	}
+	return res
+}
+
 func init() {
 	h.Partner().AddFields(fields_Partner)
 	h.Partner().NewMethod("ComputeIMStatus", partner_ComputeIMStatus)
+	h.Partner().NewMethod("IMStatuses", partner_IMStatuses)
+	h.Partner().NewMethod("IMStatusMessages", partner_IMStatusMessages)
 	h.Partner().NewMethod("IMSearch", partner_IMSearch)
+	h.Partner().NewMethod("SearchIMContacts", partner_SearchIMContacts)
 }
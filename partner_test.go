@@ -0,0 +1,87 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"testing"
+
+	"github.com/hexya-addons/bus/bustypes"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestIMSearch(t *testing.T) {
+	Convey("Testing IM search", t, func() {
+		models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			company := h.Company().Create(env, h.Company().NewData().SetName("Search Company"))
+			newUser := func(name, login string) m.UserSet {
+				return h.User().Create(env, h.User().NewData().
+					SetName(name).
+					SetLogin(login).
+					SetEmail(login+"@example.com"))
+			}
+			alice := newUser("Searched Alice", "searched_alice")
+			bob := newUser("Searched Bob", "searched_bob")
+			carol := newUser("Carol", "searched_carol")
+			carol.SetCompanies(carol.Companies().Union(company))
+			partner := h.Partner().Create(env, h.Partner().NewData().SetName("Searched Partner"))
+			h.BusPresence().Create(env, h.BusPresence().NewData().
+				SetUser(bob).
+				SetLastPoll(dates.Now()).
+				SetLastPresence(dates.Now()))
+			bob.SetPresenceStatus("", "In the office", dates.DateTime{})
+			search := func(params bustypes.IMSearchParams) []int64 {
+				var res []int64
+				for _, result := range h.Partner().NewSet(env).SearchIMContacts(params) {
+					res = append(res, result.ID)
+				}
+				return res
+			}
+			Convey("Online users come first and login is matched", func() {
+				So(search(bustypes.IMSearchParams{Name: "searched"}), ShouldResemble,
+					[]int64{bob.Partner().ID(), alice.Partner().ID(), carol.Partner().ID()})
+				results := h.Partner().NewSet(env).SearchIMContacts(bustypes.IMSearchParams{Name: "searched bob"})
+				So(results, ShouldHaveLength, 1)
+				So(results[0].UserID, ShouldEqual, bob.ID())
+				So(results[0].IMStatus, ShouldEqual, "online")
+				So(results[0].StatusMessage, ShouldEqual, "In the office")
+				So(results[0].AvatarURL, ShouldNotBeEmpty)
+			})
+			Convey("Results are paginated", func() {
+				So(search(bustypes.IMSearchParams{Name: "searched", Offset: 1, Limit: 1}), ShouldResemble, []int64{alice.Partner().ID()})
+				So(search(bustypes.IMSearchParams{Name: "searched", Offset: 5}), ShouldBeEmpty)
+				So(search(bustypes.IMSearchParams{Name: "searched", Offset: -1, Limit: 1}), ShouldResemble, []int64{carol.Partner().ID()})
+				So(search(bustypes.IMSearchParams{Name: "searched", Offset: -1, Statuses: []string{"offline"}}), ShouldResemble,
+					[]int64{alice.Partner().ID(), carol.Partner().ID()})
+			})
+			Convey("The deprecated search only matches names and orders by name", func() {
+				results := h.Partner().NewSet(env).IMSearch("searched", 0)
+				So(results, ShouldHaveLength, 2)
+				So(results[0].ID, ShouldEqual, alice.Partner().ID())
+				So(results[1].ID, ShouldEqual, bob.Partner().ID())
+				So(results[1].IMStatus, ShouldEqual, "online")
+				results = h.Partner().NewSet(env).IMSearch("searched", 1)
+				So(results, ShouldHaveLength, 1)
+				So(results[0].ID, ShouldEqual, alice.Partner().ID())
+				So(h.Partner().NewSet(env).IMSearch("searched_carol", 0), ShouldBeEmpty)
+			})
+			Convey("Results can be filtered by status, company and email", func() {
+				So(search(bustypes.IMSearchParams{Name: "searched", Statuses: []string{"online"}}), ShouldResemble, []int64{bob.Partner().ID()})
+				So(search(bustypes.IMSearchParams{Name: "searched", CompanyIDs: []int64{company.ID()}}), ShouldResemble, []int64{carol.Partner().ID()})
+				So(search(bustypes.IMSearchParams{Name: "searched_alice@example"}), ShouldResemble, []int64{alice.Partner().ID()})
+			})
+			Convey("Partners without users can be included", func() {
+				So(search(bustypes.IMSearchParams{Name: "searched partner"}), ShouldBeEmpty)
+				results := h.Partner().NewSet(env).SearchIMContacts(bustypes.IMSearchParams{Name: "searched partner", IncludePartners: true})
+				So(results, ShouldHaveLength, 1)
+				So(results[0].ID, ShouldEqual, partner.ID())
+				So(results[0].IMStatus, ShouldEqual, imPartnerStatus)
+			})
+		})
+	})
+}
@@ -0,0 +1,299 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/hexya-addons/bus/bustypes"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/fields"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
+)
+
+const (
+	// historyRetentionParam is the ConfigParameter key of the number of days presence history entries are kept
+	historyRetentionParam = "bus.presence_history_retention_days"
+	// defaultHistoryRetentionDays is the number of days presence history entries are kept if not configured
+	defaultHistoryRetentionDays = 90
+	// presenceAggregationPeriod is the period at which the daily presence statistics are updated
+	presenceAggregationPeriod = time.Hour
+)
+
+/* Presence History
+Records the transitions of the users' status computed from their activity on all
+their devices. Manual statuses and do not disturb are not taken into account so that
+the history reflects the actual activity of users.
+
+Each entry is an interval during which a user had a given status. The entry of the
+current status of a user is open, i.e. has no end date.
+
+History entries are aggregated into daily online and away durations in BusPresenceDaily.
+Entries are removed after the configured retention period, but daily statistics are kept.
+*/
+
+// historyStatuses are the statuses recorded in the presence history
+var historyStatuses = types.Selection{
+	"online":  "Online",
+	"away":    "Away",
+	"offline": "Offline",
+}
+
+var fields_BusPresenceHistory = map[string]models.FieldDefinition{
+	"User": fields.Many2One{
+		RelationModel: h.User(),
+		Required:      true,
+		Index:         true,
+		OnDelete:      `cascade`},
+
+	"Status": fields.Selection{
+		Selection: historyStatuses,
+		Required:  true},
+
+	"DateFrom": fields.DateTime{
+		String:   "From",
+		Required: true,
+		Index:    true},
+
+	"DateTo": fields.DateTime{
+		String: "To",
+		Index:  true,
+		Help:   "Empty if this is the current status of the user"},
+}
+
+var fields_BusPresenceDaily = map[string]models.FieldDefinition{
+	"User": fields.Many2One{
+		RelationModel: h.User(),
+		Required:      true,
+		Index:         true,
+		OnDelete:      `cascade`},
+
+	"Date": fields.Date{
+		Required: true,
+		Index:    true},
+
+	"OnlineDuration": fields.Integer{
+		String: "Online (seconds)"},
+
+	"AwayDuration": fields.Integer{
+		String: "Away (seconds)"},
+}
+
+// Record records the current activity status of the given users in the history
+// if it changed since the last record. It returns the recorded transitions.
+func busPresenceHistory_Record(rs m.BusPresenceHistorySet, users m.UserSet) []bustypes.PresenceTransition {
+	var res []bustypes.PresenceTransition
+	if users.IsEmpty() {
+		return res
+	}
+	statuses := usersActivityStatuses(users)
+	openEntries := h.BusPresenceHistory().NewSet(rs.Env()).Sudo().Search(
+		q.BusPresenceHistory().User().In(users).And().DateTo().IsNull())
+	current := make(map[int64]m.BusPresenceHistorySet)
+	for _, entry := range openEntries.Records() {
+		current[entry.User().ID()] = entry
+	}
+	now := presenceNow()
+	for _, user := range users.Records() {
+		status := statuses[user.ID()]
+		oldStatus := "offline"
+		entry, ok := current[user.ID()]
+		switch {
+		case ok && entry.Status() == status:
+			continue
+		case ok:
+			oldStatus = entry.Status()
+			entry.SetDateTo(now)
+		case status == "offline":
+			// Users that have never been recorded are offline
+			continue
+		}
+		h.BusPresenceHistory().NewSet(rs.Env()).Sudo().Create(h.BusPresenceHistory().NewData().
+			SetUser(user).
+			SetStatus(status).
+			SetDateFrom(now))
+		res = append(res, bustypes.PresenceTransition{
+			UserID:    user.ID(),
+			OldStatus: oldStatus,
+			NewStatus: status,
+		})
+	}
+	return res
+}
+
+// Gc removes the closed history entries that are older than the configured retention period.
+func busPresenceHistory_Gc(rs m.BusPresenceHistorySet) int64 {
+	days, err := strconv.Atoi(h.ConfigParameter().NewSet(rs.Env()).Sudo().GetParam(historyRetentionParam, ""))
+	if err != nil || days <= 0 {
+		days = defaultHistoryRetentionDays
+	}
+	limit := presenceNow().AddDate(0, 0, -days)
+	return h.BusPresenceHistory().NewSet(rs.Env()).Sudo().Search(
+		q.BusPresenceHistory().DateTo().IsNotNull().And().DateTo().Lower(limit)).Unlink()
+}
+
+// Aggregate computes the online and away durations of all users on the given day (UTC),
+// replacing the existing statistics of this day.
+func busPresenceDaily_Aggregate(rs m.BusPresenceDailySet, day dates.Date) {
+	dayStart := day.ToDateTime()
+	dayEnd := dayStart.AddDate(0, 0, 1)
+	now := presenceNow()
+	entries := h.BusPresenceHistory().NewSet(rs.Env()).Sudo().Search(
+		q.BusPresenceHistory().Status().In([]string{"online", "away"}).
+			And().DateFrom().Lower(dayEnd).
+			AndCond(q.BusPresenceHistory().DateTo().IsNull().
+				Or().DateTo().Greater(dayStart)))
+	durations := make(map[int64]map[string]time.Duration)
+	for _, entry := range entries.Records() {
+		from, to := entry.DateFrom(), entry.DateTo()
+		if to.IsZero() {
+			to = now
+		}
+		if from.Lower(dayStart) {
+			from = dayStart
+		}
+		if to.Greater(dayEnd) {
+			to = dayEnd
+		}
+		if !from.Lower(to) {
+			continue
+		}
+		userID := entry.User().ID()
+		if durations[userID] == nil {
+			durations[userID] = make(map[string]time.Duration)
+		}
+		durations[userID][entry.Status()] += to.Sub(from)
+	}
+	h.BusPresenceDaily().NewSet(rs.Env()).Sudo().Search(q.BusPresenceDaily().Date().Equals(day)).Unlink()
+	for userID, userDurations := range durations {
+		h.BusPresenceDaily().NewSet(rs.Env()).Sudo().Create(h.BusPresenceDaily().NewData().
+			SetUser(h.User().BrowseOne(rs.Env(), userID)).
+			SetDate(day).
+			SetOnlineDuration(int64(userDurations["online"] / time.Second)).
+			SetAwayDuration(int64(userDurations["away"] / time.Second)))
+	}
+}
+
+// aggregatePresences updates the daily presence statistics of yesterday and today.
+//
+// Yesterday is updated too so that the last hour of each day is taken into account.
+func aggregatePresences() {
+	models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		today := presenceToday()
+		h.BusPresenceDaily().NewSet(env).Aggregate(today.AddDate(0, 0, -1))
+		h.BusPresenceDaily().NewSet(env).Aggregate(today)
+	})
+}
+
+// LastOnline returns the last date at which this user was online, that is now if
+// the user is currently online. It returns a zero date if the user has never been
+// online or if the history has been removed.
+//
+// It also returns a zero date if the current user cannot see the presence of this
+// user or if this user chose not to show their last activity date.
+func user_LastOnline(rs m.UserSet) dates.DateTime {
+	rs.EnsureOne()
+	shown := h.BusPresenceSettings().NewSet(rs.Env()).Sudo().Search(
+		q.BusPresenceSettings().User().Equals(rs).And().ShowLastSeen().Equals(true))
+	if shown.IsEmpty() || !visibleUsers(rs.Env(), rs)[rs.ID()] {
+		return dates.DateTime{}
+	}
+	entries := h.BusPresenceHistory().NewSet(rs.Env()).Sudo().Search(
+		q.BusPresenceHistory().User().Equals(rs).And().Status().Equals("online"))
+	if !entries.Search(q.BusPresenceHistory().DateTo().IsNull()).IsEmpty() {
+		return presenceNow()
+	}
+	last := entries.OrderBy("DateTo desc").Limit(1)
+	if last.IsEmpty() {
+		return dates.DateTime{}
+	}
+	return last.DateTo()
+}
+
+// PresenceHistory returns the status intervals of these users that overlap the given
+// period, ordered by date. Intervals are clipped to the period and the interval of the
+// current status of a user ends now.
+//
+// Users whose presence cannot be seen by the current user have no intervals.
+func user_PresenceHistory(rs m.UserSet, from, to dates.DateTime) []bustypes.PresenceInterval {
+	res := []bustypes.PresenceInterval{}
+	users := filterVisibleUsers(rs)
+	if users.IsEmpty() {
+		return res
+	}
+	entries := h.BusPresenceHistory().NewSet(rs.Env()).Sudo().Search(
+		q.BusPresenceHistory().User().In(users).
+			And().DateFrom().Lower(to).
+			AndCond(q.BusPresenceHistory().DateTo().IsNull().
+				Or().DateTo().Greater(from))).OrderBy("DateFrom", "ID")
+	now := presenceNow()
+	for _, entry := range entries.Records() {
+		interval := bustypes.PresenceInterval{
+			UserID: entry.User().ID(),
+			Status: entry.Status(),
+			From:   entry.DateFrom(),
+			To:     entry.DateTo(),
+		}
+		if interval.To.IsZero() {
+			interval.To = now
+		}
+		if interval.From.Lower(from) {
+			interval.From = from
+		}
+		if interval.To.Greater(to) {
+			interval.To = to
+		}
+		res = append(res, interval)
+	}
+	return res
+}
+
+// PresenceStats returns the daily presence statistics of these users between the
+// given dates included, ordered by date.
+//
+// Users whose presence cannot be seen by the current user have no statistics.
+func user_PresenceStats(rs m.UserSet, from, to dates.Date) []bustypes.PresenceDailyStats {
+	res := []bustypes.PresenceDailyStats{}
+	users := filterVisibleUsers(rs)
+	if users.IsEmpty() {
+		return res
+	}
+	stats := h.BusPresenceDaily().NewSet(rs.Env()).Sudo().Search(
+		q.BusPresenceDaily().User().In(users).
+			And().Date().GreaterOrEqual(from).
+			And().Date().LowerOrEqual(to)).OrderBy("Date", "User")
+	for _, stat := range stats.Records() {
+		res = append(res, bustypes.PresenceDailyStats{
+			UserID:         stat.User().ID(),
+			Date:           stat.Date(),
+			OnlineDuration: stat.OnlineDuration(),
+			AwayDuration:   stat.AwayDuration(),
+		})
+	}
+	return res
+}
+
+func init() {
+	models.NewModel("BusPresenceHistory")
+	h.BusPresenceHistory().AddFields(fields_BusPresenceHistory)
+	h.BusPresenceHistory().NewMethod("Record", busPresenceHistory_Record)
+	h.BusPresenceHistory().NewMethod("Gc", busPresenceHistory_Gc)
+
+	models.NewModel("BusPresenceDaily")
+	h.BusPresenceDaily().AddFields(fields_BusPresenceDaily)
+	h.BusPresenceDaily().NewMethod("Aggregate", busPresenceDaily_Aggregate)
+	h.BusPresenceDaily().AddSQLConstraint("user_date_uniq", "unique(user_id, date)", "There can only be one statistic per user and day")
+
+	h.User().NewMethod("LastOnline", user_LastOnline)
+	h.User().NewMethod("PresenceHistory", user_PresenceHistory)
+	h.User().NewMethod("PresenceStats", user_PresenceStats)
+
+	models.RegisterWorker(models.NewWorkerFunction(aggregatePresences, presenceAggregationPeriod))
+}
@@ -0,0 +1,100 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPresenceHistory(t *testing.T) {
+	Convey("Testing presence history", t, func() {
+		models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			user := h.User().Create(env, h.User().NewData().SetName("History User").SetLogin("history_user"))
+			user.SetPresencePrivacy("everyone", true, false)
+			presence := h.BusPresence().Create(env, h.BusPresence().NewData().
+				SetUser(user).
+				SetLastPoll(dates.Now()).
+				SetLastPresence(dates.Now()))
+			history := func() m.BusPresenceHistorySet {
+				return h.BusPresenceHistory().Search(env, q.BusPresenceHistory().User().Equals(user)).OrderBy("ID")
+			}
+			Convey("Status transitions are recorded", func() {
+				presence.UpdateStatus()
+				So(history().Len(), ShouldEqual, 1)
+				So(history().Status(), ShouldEqual, "online")
+				So(user.LastOnline().Time, ShouldHappenWithin, 2*time.Second, time.Now())
+				presence.UpdateStatus()
+				So(history().Len(), ShouldEqual, 1)
+
+				presence.SetLastPresence(dates.Now().Add(-2 * defaultAwayTimer))
+				presence.UpdateStatus()
+				entries := history().Records()
+				So(entries, ShouldHaveLength, 2)
+				So(entries[0].DateTo().IsZero(), ShouldBeFalse)
+				So(entries[1].Status(), ShouldEqual, "away")
+				So(entries[1].DateTo().IsZero(), ShouldBeTrue)
+				So(user.LastOnline().Equal(entries[0].DateTo()), ShouldBeTrue)
+
+				intervals := user.PresenceHistory(dates.Now().Add(-time.Hour), dates.Now().Add(time.Hour))
+				So(intervals, ShouldHaveLength, 2)
+				So(intervals[0].Status, ShouldEqual, "online")
+				So(intervals[1].Status, ShouldEqual, "away")
+			})
+			Convey("History follows the presence privacy of users", func() {
+				presence.UpdateStatus()
+				viewer := h.User().Create(env, h.User().NewData().SetName("History Viewer").SetLogin("history_viewer"))
+				viewed := user.Sudo(viewer.ID())
+				So(viewed.PresenceHistory(dates.Now().Add(-time.Hour), dates.Now().Add(time.Hour)), ShouldHaveLength, 1)
+				So(viewed.LastOnline().IsZero(), ShouldBeFalse)
+				user.SetPresencePrivacy("everyone", false, false)
+				So(viewed.LastOnline().IsZero(), ShouldBeTrue)
+				user.SetPresencePrivacy("nobody", true, false)
+				So(viewed.LastOnline().IsZero(), ShouldBeTrue)
+				So(viewed.PresenceHistory(dates.Now().Add(-time.Hour), dates.Now().Add(time.Hour)), ShouldBeEmpty)
+				So(viewed.PresenceStats(dates.Today(), dates.Today()), ShouldBeEmpty)
+				So(user.PresenceHistory(dates.Now().Add(-time.Hour), dates.Now().Add(time.Hour)), ShouldHaveLength, 1)
+			})
+			Convey("History is aggregated into daily statistics", func() {
+				day := dates.ParseDate("2020-06-10")
+				at := func(hour, min int) dates.DateTime {
+					return dates.DateTime{Time: time.Date(2020, 6, 10, hour, min, 0, 0, time.UTC)}
+				}
+				for _, entry := range []struct {
+					status   string
+					from, to dates.DateTime
+				}{
+					{"online", at(0, 0).Add(-time.Hour), at(1, 0)},
+					{"away", at(1, 0), at(1, 30)},
+					{"online", at(1, 30), at(2, 0)},
+					{"offline", at(2, 0), at(23, 0)},
+					{"online", at(23, 0), at(23, 0).Add(2 * time.Hour)},
+				} {
+					h.BusPresenceHistory().Create(env, h.BusPresenceHistory().NewData().
+						SetUser(user).
+						SetStatus(entry.status).
+						SetDateFrom(entry.from).
+						SetDateTo(entry.to))
+				}
+				h.BusPresenceDaily().NewSet(env).Aggregate(day)
+				stats := user.PresenceStats(day, day)
+				So(stats, ShouldHaveLength, 1)
+				So(stats[0].OnlineDuration, ShouldEqual, int64((2*time.Hour+30*time.Minute)/time.Second))
+				So(stats[0].AwayDuration, ShouldEqual, int64(30*time.Minute/time.Second))
+				Convey("Aggregating again replaces the statistics", func() {
+					h.BusPresenceDaily().NewSet(env).Aggregate(day)
+					So(user.PresenceStats(day, day), ShouldHaveLength, 1)
+				})
+			})
+		})
+	})
+}
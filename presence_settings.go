@@ -0,0 +1,199 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/fields"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
+)
+
+/* Presence Settings
+Holds the presence preferences of a user, such as a manually set status.
+Unlike BusPresence which has one record per device, there is at most one
+record per user.
+*/
+
+// manualStatuses are the statuses that a user can set manually
+var manualStatuses = types.Selection{
+	"online":    "Online",
+	"away":      "Away",
+	"busy":      "Busy",
+	"invisible": "Invisible",
+}
+
+var fields_BusPresenceSettings = map[string]models.FieldDefinition{
+	"User": fields.One2One{
+		RelationModel: h.User(),
+		Required:      true,
+		Index:         true,
+		OnDelete:      `cascade`},
+
+	"ManualStatus": fields.Selection{
+		Selection: manualStatuses,
+		Help: `Status set by the user, overriding the status computed from its activity.
+Invisible users appear offline to others.`},
+
+	"StatusMessage": fields.Char{},
+
+	"StatusExpiry": fields.DateTime{
+		Help: "The manual status and status message are cleared after this date"},
+
+	"PresenceVisibility": fields.Selection{
+		Selection: presenceVisibilities,
+		String:    "Who Can See My Status",
+		Required:  true,
+		Default:   models.DefaultValue("everyone")},
+
+	"ShowLastSeen": fields.Boolean{
+		String: "Show Last Seen",
+		Help:   "Let the users who can see my status know when I was last active"},
+
+	"HideFromPortal": fields.Boolean{
+		String: "Hide My Status From Portal Users"},
+
+	"DNDSchedule": fields.Boolean{
+		String: "Do Not Disturb Outside Working Hours"},
+
+	"WorkHourFrom": fields.Float{
+		String:  "Working Hours From",
+		Default: models.DefaultValue(8.0),
+		Help:    "Start of the working hours in the user's time zone, e.g. 8.5 for 08:30"},
+
+	"WorkHourTo": fields.Float{
+		String:  "Working Hours To",
+		Default: models.DefaultValue(18.0),
+		Help: `End of the working hours in the user's time zone, e.g. 17.5 for 17:30.
+It can be lower than the start for night shifts.`},
+
+	"DNDWeekends": fields.Boolean{
+		String: "Do Not Disturb On Weekends"},
+
+	"SnoozeUntil": fields.DateTime{
+		Help: "Do not disturb until this date"},
+
+	"DNDActive": fields.Boolean{
+		String:   "Do Not Disturb Active",
+		ReadOnly: true,
+		Help:     "Whether do not disturb was active at the last check"},
+}
+
+// presenceSettings holds the active presence settings of a user
+type presenceSettings struct {
+	manualStatus  string
+	statusMessage string
+	dnd           bool
+}
+
+// usersPresenceSettings returns the active presence settings of the given users
+// by user ID. Users without settings are not included in the result.
+func usersPresenceSettings(users m.UserSet) map[int64]presenceSettings {
+	res := make(map[int64]presenceSettings)
+	if users.IsEmpty() {
+		return res
+	}
+	now := presenceNow()
+	settings := h.BusPresenceSettings().NewSet(users.Env()).Sudo().Search(q.BusPresenceSettings().User().In(users))
+	for _, setting := range settings.Records() {
+		var ps presenceSettings
+		if setting.StatusExpiry().IsZero() || setting.StatusExpiry().Greater(now) {
+			ps.manualStatus = setting.ManualStatus()
+			ps.statusMessage = setting.StatusMessage()
+		}
+		ps.dnd = setting.IsDND(now)
+		res[setting.User().ID()] = ps
+	}
+	return res
+}
+
+// applyPresenceSettings returns the status that others see for a user whose
+// status computed from its activity is status and who has the given settings.
+//
+// Settings never make a disconnected user appear connected.
+func applyPresenceSettings(status string, settings presenceSettings) string {
+	switch {
+	case status == "offline":
+		return status
+	case settings.manualStatus == "invisible":
+		return "offline"
+	case settings.dnd:
+		return "dnd"
+	case settings.manualStatus != "":
+		return settings.manualStatus
+	default:
+		return status
+	}
+}
+
+// ClearExpiredStatus clears the manual status and status message of the settings
+// that have expired and publishes the resulting status changes.
+func busPresenceSettings_ClearExpiredStatus(rs m.BusPresenceSettingsSet) {
+	expired := h.BusPresenceSettings().NewSet(rs.Env()).Sudo().Search(
+		q.BusPresenceSettings().StatusExpiry().IsNotNull().
+			And().StatusExpiry().Lower(presenceNow()))
+	if expired.IsEmpty() {
+		return
+	}
+	partners := h.Partner().NewSet(rs.Env())
+	for _, setting := range expired.Records() {
+		partners = partners.Union(setting.User().Partner())
+	}
+	expired.Write(h.BusPresenceSettings().NewData().
+		SetManualStatus("").
+		SetStatusMessage("").
+		SetStatusExpiry(dates.DateTime{}))
+	publishPartnersStatus(partners)
+}
+
+// SetPresenceStatus sets the manual status and the status message of these users.
+//
+// An empty status means that the status is computed from the users' activity.
+// If expiry is not zero, the status and message are cleared at this date.
+func user_SetPresenceStatus(rs m.UserSet, status, message string, expiry dates.DateTime) {
+	if _, ok := manualStatuses[status]; status != "" && !ok {
+		panic(rs.T("Unknown status: %s", status))
+	}
+	partners := h.Partner().NewSet(rs.Env())
+	for _, user := range rs.Records() {
+		values := h.BusPresenceSettings().NewData().
+			SetManualStatus(status).
+			SetStatusMessage(message).
+			SetStatusExpiry(expiry)
+		setting := h.BusPresenceSettings().NewSet(rs.Env()).Sudo().Search(q.BusPresenceSettings().User().Equals(user))
+		if setting.IsEmpty() {
+			h.BusPresenceSettings().NewSet(rs.Env()).Sudo().Create(values.SetUser(user))
+		} else {
+			setting.Write(values)
+		}
+		partners = partners.Union(user.Partner())
+	}
+	publishPartnersStatus(partners)
+}
+
+// IMStatusMessages returns the status message of each user of this recordset, by user ID.
+//
+// Messages of users whose presence cannot be seen by the current user are not returned.
+func user_IMStatusMessages(rs m.UserSet) map[int64]string {
+	res := make(map[int64]string)
+	visible := visibleUsers(rs.Env(), rs)
+	for userID, settings := range usersPresenceSettings(rs) {
+		if settings.statusMessage != "" && visible[userID] {
+			res[userID] = settings.statusMessage
+		}
+	}
+	return res
+}
+
+func init() {
+	models.NewModel("BusPresenceSettings")
+	h.BusPresenceSettings().AddFields(fields_BusPresenceSettings)
+	h.BusPresenceSettings().NewMethod("ClearExpiredStatus", busPresenceSettings_ClearExpiredStatus)
+
+	h.User().NewMethod("SetPresenceStatus", user_SetPresenceStatus)
+	h.User().NewMethod("IMStatusMessages", user_IMStatusMessages)
+}
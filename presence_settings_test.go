@@ -0,0 +1,56 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/q"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestManualStatus(t *testing.T) {
+	Convey("Testing manual statuses", t, func() {
+		models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			user := h.User().Create(env, h.User().NewData().SetName("Manual User").SetLogin("manual_user"))
+			presence := h.BusPresence().Create(env, h.BusPresence().NewData().
+				SetUser(user).
+				SetLastPoll(dates.Now()).
+				SetLastPresence(dates.Now()))
+			Convey("Manual status overrides the computed status", func() {
+				user.SetPresenceStatus("busy", "In a meeting", dates.DateTime{})
+				So(user.IMStatus(), ShouldEqual, "busy")
+				So(user.Partner().IMStatus(), ShouldEqual, "busy")
+				So(user.IMStatusMessages()[user.ID()], ShouldEqual, "In a meeting")
+				So(user.Partner().IMStatusMessages()[user.Partner().ID()], ShouldEqual, "In a meeting")
+			})
+			Convey("Invisible users appear offline", func() {
+				user.SetPresenceStatus("invisible", "", dates.DateTime{})
+				So(user.IMStatus(), ShouldEqual, "offline")
+			})
+			Convey("Manual status does not make disconnected users online", func() {
+				user.SetPresenceStatus("online", "", dates.DateTime{})
+				presence.SetLastPoll(dates.Now().Add(-2 * defaultDisconnectionTimer))
+				So(user.IMStatus(), ShouldEqual, "offline")
+			})
+			Convey("Expired manual statuses are ignored and cleared", func() {
+				user.SetPresenceStatus("away", "Lunch", dates.Now().Add(-time.Minute))
+				So(user.IMStatus(), ShouldEqual, "online")
+				So(user.IMStatusMessages(), ShouldBeEmpty)
+				h.BusPresenceSettings().NewSet(env).ClearExpiredStatus()
+				settings := h.BusPresenceSettings().Search(env, q.BusPresenceSettings().User().Equals(user))
+				So(settings.ManualStatus(), ShouldBeBlank)
+				So(settings.StatusMessage(), ShouldBeBlank)
+			})
+			Convey("Unknown statuses are rejected", func() {
+				So(func() { user.SetPresenceStatus("sleeping", "", dates.DateTime{}) }, ShouldPanic)
+			})
+		})
+	})
+}
@@ -0,0 +1,333 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/hexya-addons/bus/bustypes"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/q"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPresencePublication(t *testing.T) {
+	cl := newTestClient()
+	Convey("Presence changes are published", t, func() {
+		var (
+			channel string
+			last    int64
+		)
+		flushPresences()
+		models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			admin := h.User().BrowseOne(env, security.SuperUserID)
+			channel = PresenceChannel(admin.Partner().ID())
+			// Start from a user without presence and ignore the changes published by other tests
+			h.BusPresence().Search(env, q.BusPresence().User().Equals(admin)).Unlink()
+			last = h.BusBus().NewSet(env).SearchAll().OrderBy("ID desc").Limit(1).ID()
+		})
+		pollPresence := func() []*bustypes.Notification {
+			_, err := cl.RPC("/longpolling/poll", "call", bustypes.PollParams{
+				Channels: []string{channel},
+				Last:     0,
+				Options:  types.NewContext().WithKey("peek", true).WithKey("bus_inactivity", 0),
+			})
+			So(err, ShouldBeNil)
+			flushPresences()
+			var notifs []*bustypes.Notification
+			models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+				notifs = h.BusBus().NewSet(env).Poll([]string{channel}, last, types.NewContext(), false)
+			})
+			return notifs
+		}
+		notifs := pollPresence()
+		So(notifs, ShouldHaveLength, 1)
+		So(notifs[0].Message.(map[string]interface{})["im_status"], ShouldEqual, "online")
+		Convey("Polling again does not publish the same status", func() {
+			So(pollPresence(), ShouldHaveLength, 1)
+		})
+		Convey("Timer based transitions are published by the sweeper", func() {
+			models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+				presence := h.BusPresence().Search(env, q.BusPresence().User().Equals(h.User().BrowseOne(env, security.SuperUserID)))
+				presence.SetLastPoll(dates.Now().Add(-2 * defaultDisconnectionTimer))
+				So(presence.Status(), ShouldEqual, "online")
+			})
+			sweepPresences()
+			models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+				presence := h.BusPresence().Search(env, q.BusPresence().User().Equals(h.User().BrowseOne(env, security.SuperUserID)))
+				So(presence.Status(), ShouldEqual, "offline")
+				notifs := h.BusBus().NewSet(env).Poll([]string{channel}, last, types.NewContext(), false)
+				So(notifs, ShouldHaveLength, 2)
+				So(notifs[1].Message.(map[string]interface{})["im_status"], ShouldEqual, "offline")
+			})
+		})
+	})
+}
+
+func TestPresenceEndpoints(t *testing.T) {
+	cl := newTestClient()
+	Convey("Testing presence heartbeat and status endpoints", t, func() {
+		var partnerID int64
+		models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			partnerID = h.User().BrowseOne(env, security.SuperUserID).Partner().ID()
+		})
+		_, err := cl.RPC("/longpolling/heartbeat", "call", bustypes.HeartbeatParams{Inactivity: 0})
+		So(err, ShouldBeNil)
+		flushPresences()
+		msg, err := cl.RPC("/longpolling/im_status", "call", bustypes.IMStatusParams{
+			PartnerIDs: []int64{partnerID},
+			UserIDs:    []int64{security.SuperUserID},
+		})
+		So(err, ShouldBeNil)
+		var res bustypes.IMStatusResult
+		So(json.Unmarshal(msg, &res), ShouldBeNil)
+		So(res.Partners, ShouldResemble, []bustypes.IMStatus{{ID: partnerID, IMStatus: "online"}})
+		So(res.Users, ShouldResemble, []bustypes.IMStatus{{ID: security.SuperUserID, IMStatus: "online"}})
+
+		// A negative inactivity does not set the last presence in the future
+		_, err = cl.RPC("/longpolling/heartbeat", "call", bustypes.HeartbeatParams{Inactivity: -3600000})
+		So(err, ShouldBeNil)
+		flushPresences()
+		models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			So(h.BusPresence().Search(env, q.BusPresence().User().Equals(h.User().BrowseOne(env, security.SuperUserID)).
+				And().LastPresence().Greater(dates.Now().Add(time.Minute))).IsEmpty(), ShouldBeTrue)
+		})
+	})
+}
+
+func TestIMStatus(t *testing.T) {
+	Convey("Testing IM status computation", t, func() {
+		models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			partner := h.Partner().Create(env, h.Partner().NewData().SetName("Shared Partner"))
+			user1 := h.User().Create(env, h.User().NewData().SetName("User 1").SetLogin("imstatus_user1").SetPartner(partner))
+			user2 := h.User().Create(env, h.User().NewData().SetName("User 2").SetLogin("imstatus_user2").SetPartner(partner))
+			user3 := h.User().Create(env, h.User().NewData().SetName("User 3").SetLogin("imstatus_user3"))
+			users := user1.Union(user2).Union(user3)
+			h.BusPresence().Create(env, h.BusPresence().NewData().
+				SetUser(user1).
+				SetLastPoll(dates.Now().Add(-2*defaultDisconnectionTimer)).
+				SetLastPresence(dates.Now().Add(-2*defaultDisconnectionTimer)))
+			presence2 := h.BusPresence().Create(env, h.BusPresence().NewData().
+				SetUser(user2).
+				SetLastPoll(dates.Now()).
+				SetLastPresence(dates.Now().Add(-2*defaultAwayTimer)))
+			Convey("Users statuses are computed for the whole recordset", func() {
+				So(users.IMStatuses(), ShouldResemble, map[int64]string{
+					user1.ID(): "offline",
+					user2.ID(): "away",
+					user3.ID(): "offline",
+				})
+				So(user2.IMStatus(), ShouldEqual, "away")
+			})
+			Convey("Partner status is the best status of its users", func() {
+				So(partner.IMStatus(), ShouldEqual, "away")
+				presence2.SetLastPresence(dates.Now())
+				partners := partner.Union(user3.Partner())
+				So(partners.IMStatuses(), ShouldResemble, map[int64]string{
+					partner.ID():         "online",
+					user3.Partner().ID(): "offline",
+				})
+			})
+			Convey("Partners without users are offline", func() {
+				other := h.Partner().Create(env, h.Partner().NewData().SetName("No User"))
+				So(other.IMStatus(), ShouldEqual, "offline")
+			})
+		})
+		Convey("Legacy clients still get the status of the partners of their poll options", func() {
+			var partnerID int64
+			models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+				partnerID = h.User().BrowseOne(env, security.SuperUserID).Partner().ID()
+			})
+			options := types.NewContext().WithKey("peek", true).WithKey("bus_presence_partner_ids", []int64{partnerID})
+			res, err := newBusDispatcher().PollE(security.SuperUserID, []string{"legacy.presence"}, 0, options)
+			So(err, ShouldBeNil)
+			So(res, ShouldHaveLength, 1)
+			So(res[0].ID, ShouldEqual, -1)
+			So(res[0].Channel, ShouldEqual, "bus.presence")
+			So(res[0].Message.(map[string]interface{})["id"], ShouldEqual, partnerID)
+			models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+				So(h.BusBus().NewSet(env).Poll([]string{"legacy.presence"}, 0, options, false), ShouldBeEmpty)
+				forced := h.BusBus().NewSet(env).Poll([]string{"legacy.presence"}, 0, options, true)
+				So(forced, ShouldHaveLength, 1)
+				So(forced[0].Channel, ShouldEqual, "bus.presence")
+			})
+		})
+	})
+}
+
+func TestPresenceBuffer(t *testing.T) {
+	Convey("Testing presence updates coalescing", t, func() {
+		buffer := &presenceBuffer{updates: make(map[presenceKey]presenceUpdate)}
+		now := dates.Now()
+		desktop := bustypes.Device{Key: "1", DeviceType: "desktop"}
+		mobile := bustypes.Device{Key: "2", DeviceType: "mobile"}
+		buffer.add(1, presenceUpdate{device: desktop, lastPoll: now.Add(-time.Minute), lastPresence: now})
+		buffer.add(1, presenceUpdate{device: desktop, lastPoll: now, lastPresence: now.Add(-time.Hour)})
+		buffer.add(1, presenceUpdate{device: mobile, lastPoll: now, lastPresence: now})
+		buffer.add(2, presenceUpdate{device: desktop, lastPoll: now, lastPresence: now})
+		updates := buffer.pop()
+		So(updates, ShouldHaveLength, 3)
+		desktopUpdate := updates[presenceKey{uid: 1, device: "1"}]
+		So(desktopUpdate.lastPoll.Equal(now), ShouldBeTrue)
+		So(desktopUpdate.lastPresence.Equal(now), ShouldBeTrue)
+		So(buffer.pop(), ShouldBeEmpty)
+
+		buffer.add(1, presenceUpdate{device: desktop, lastPoll: now, lastPresence: now})
+		buffer.add(1, presenceUpdate{device: mobile, lastPoll: now, lastPresence: now})
+		buffer.add(2, presenceUpdate{device: desktop, lastPoll: now, lastPresence: now})
+		buffer.remove(1, "2")
+		So(buffer.updates, ShouldHaveLength, 2)
+		buffer.remove(1, "")
+		So(buffer.pop(), ShouldHaveLength, 1)
+	})
+	Convey("Testing presence flush failures", t, func() {
+		var adminID int64
+		models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			adminID = h.User().Search(env, q.User().Login().Equals("admin")).ID()
+		})
+		// The user of this update does not exist, so that its presence cannot be created
+		badKey := presenceKey{uid: 999999999, device: "flush-bad"}
+		device := bustypes.Device{Key: "flush-good", DeviceType: "desktop"}
+		pendingPresences.add(badKey.uid, presenceUpdate{device: bustypes.Device{Key: badKey.device}, lastPoll: dates.Now(), lastPresence: dates.Now()})
+		pendingPresences.add(adminID, presenceUpdate{device: device, lastPoll: dates.Now(), lastPresence: dates.Now()})
+		flushPresences()
+		models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			presence := h.BusPresence().Search(env, q.BusPresence().DeviceKey().Equals("flush-good"))
+			So(presence.Len(), ShouldEqual, 1)
+			presence.Unlink()
+		})
+		pendingPresences.Lock()
+		So(pendingPresences.updates[badKey].attempts, ShouldEqual, 1)
+		pendingPresences.Unlock()
+		for i := 1; i < maxPresenceFlushAttempts; i++ {
+			flushPresences()
+		}
+		pendingPresences.Lock()
+		_, pending := pendingPresences.updates[badKey]
+		pendingPresences.Unlock()
+		So(pending, ShouldBeFalse)
+	})
+}
+
+func TestDevicePresence(t *testing.T) {
+	cl1 := newTestClient()
+	cl2 := newTestClient()
+	Convey("Testing multi-device presence", t, func() {
+		models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			user := h.User().Create(env, h.User().NewData().SetName("Device User").SetLogin("device_user"))
+			h.BusPresence().Create(env, h.BusPresence().NewData().
+				SetUser(user).
+				SetDeviceKey("desktop-session").
+				SetDeviceType("desktop").
+				SetUserAgent("Mozilla/5.0 (X11; Linux x86_64)").
+				SetLastPoll(dates.Now()).
+				SetLastPresence(dates.Now().Add(-2*defaultAwayTimer)))
+			h.BusPresence().Create(env, h.BusPresence().NewData().
+				SetUser(user).
+				SetDeviceKey("mobile-session").
+				SetDeviceType("mobile").
+				SetLastPoll(dates.Now()).
+				SetLastPresence(dates.Now()))
+			Convey("User status is the best status of its devices", func() {
+				So(user.IMStatus(), ShouldEqual, "online")
+			})
+			Convey("Devices are listed with their own status", func() {
+				devices := user.IMDevices()[user.ID()]
+				So(devices, ShouldHaveLength, 2)
+				statuses := make(map[string]string)
+				for _, device := range devices {
+					statuses[device.DeviceType] = device.IMStatus
+				}
+				So(statuses, ShouldResemble, map[string]string{"desktop": "away", "mobile": "online"})
+			})
+			Convey("Device details are restricted to their user and system users", func() {
+				colleague := h.User().Create(env, h.User().NewData().SetName("Device Colleague").SetLogin("device_colleague"))
+				devices := user.Sudo(colleague.ID()).IMDevices()[user.ID()]
+				So(devices, ShouldHaveLength, 2)
+				for _, device := range devices {
+					So(device.DeviceType, ShouldNotBeBlank)
+					So(device.IMStatus, ShouldNotBeBlank)
+					So(device.Key, ShouldBeBlank)
+					So(device.UserAgent, ShouldBeBlank)
+					So(device.LastPoll.IsZero(), ShouldBeTrue)
+				}
+				for _, device := range user.IMDevices()[user.ID()] {
+					So(device.Key, ShouldBeBlank)
+					So(device.LastPoll.IsZero(), ShouldBeFalse)
+				}
+				own := user.Sudo(user.ID()).IMDevices()[user.ID()]
+				So(own[0].Key, ShouldNotBeBlank)
+				So(own[0].LastPoll.IsZero(), ShouldBeFalse)
+			})
+		})
+		Convey("Each session of a user is a device", func() {
+			start := dates.Now().Add(-time.Second)
+			_, err := cl1.RPC("/longpolling/heartbeat", "call", bustypes.HeartbeatParams{DeviceType: "tablet"})
+			So(err, ShouldBeNil)
+			_, err = cl2.RPC("/longpolling/heartbeat", "call", bustypes.HeartbeatParams{DeviceType: "mobile"})
+			So(err, ShouldBeNil)
+			flushPresences()
+			keys := make(map[string]string)
+			models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+				admin := h.User().Search(env, q.User().Login().Equals("admin"))
+				for _, device := range admin.IMDevices()[admin.ID()] {
+					if device.LastPoll.Greater(start) {
+						keys[device.DeviceType] = device.Key
+					}
+				}
+			})
+			So(keys["tablet"], ShouldNotBeBlank)
+			So(keys["mobile"], ShouldNotBeBlank)
+			So(keys["tablet"], ShouldNotEqual, keys["mobile"])
+		})
+	})
+}
+
+func TestLogoutPresence(t *testing.T) {
+	Convey("Testing presence on logout", t, func() {
+		TrackChannelListeners("logout.")
+		models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			user := h.User().Create(env, h.User().NewData().SetName("Logout User").SetLogin("logout_user"))
+			user.SetPresencePrivacy("everyone", true, false)
+			lastPresence := dates.Now().Add(-time.Minute)
+			for _, device := range []string{"logout-desktop", "logout-mobile"} {
+				h.BusPresence().Create(env, h.BusPresence().NewData().
+					SetUser(user).
+					SetDeviceKey(device).
+					SetLastPoll(dates.Now()).
+					SetLastPresence(lastPresence))
+			}
+			presences := h.BusPresence().NewSet(env).Sudo(user.ID())
+			h.BusPresence().Search(env, q.BusPresence().User().Equals(user)).UpdateStatus()
+			h.BusChannelListener().NewSet(env).Sudo(user.ID()).Track("logout-desktop", []string{"logout.record"}, nil)
+			So(user.IMStatus(), ShouldEqual, "online")
+			Convey("Logging out from a device only disconnects this device", func() {
+				presences.Disconnect("logout-desktop")
+				So(user.IMStatus(), ShouldEqual, "online")
+				statuses := make(map[string]string)
+				for _, device := range user.IMDevices()[user.ID()] {
+					statuses[device.Key] = device.IMStatus
+				}
+				So(statuses, ShouldResemble, map[string]string{"logout-desktop": "offline", "logout-mobile": "online"})
+				So(h.BusChannelListener().NewSet(env).Listeners("logout.record"), ShouldBeEmpty)
+				Convey("The user is offline once logged out from all devices", func() {
+					presences.Disconnect("logout-mobile")
+					So(user.IMStatus(), ShouldEqual, "offline")
+					So(user.LastOnline().Greater(lastPresence), ShouldBeTrue)
+				})
+			})
+			Convey("An empty device key disconnects all devices", func() {
+				presences.Disconnect("")
+				So(user.IMStatus(), ShouldEqual, "offline")
+				So(h.BusChannelListener().NewSet(env).Listeners("logout.record"), ShouldBeEmpty)
+			})
+		})
+	})
+}
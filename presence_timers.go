@@ -0,0 +1,125 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/hexya-addons/bus/bustypes"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/fields"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+)
+
+const (
+	// awayTimerParam is the ConfigParameter key of the number of minutes of inactivity after which users are away
+	awayTimerParam = "bus.away_timer"
+	// disconnectionTimerParam is the ConfigParameter key of the number of seconds without poll after which users are offline
+	disconnectionTimerParam = "bus.disconnection_timer"
+	// minDisconnectionTimer is the lowest disconnection timer. Below it, users that poll
+	// continuously would be seen offline between two polls or before their presence is flushed.
+	minDisconnectionTimer = defaultTimeout + presenceFlushPeriod
+)
+
+/* Presence Timers
+The away and disconnection timers are defined globally in the settings and can be
+overridden per company. The timers of a user are the ones of its current company.
+Disconnection timers lower than minDisconnectionTimer are raised to it.
+*/
+
+var fields_Company = map[string]models.FieldDefinition{
+	"BusAwayTimer": fields.Integer{
+		String: "Away Timer (minutes)",
+		Help:   "Minutes of inactivity after which users of this company are away. Zero uses the global setting."},
+
+	"BusDisconnectionTimer": fields.Integer{
+		String:     "Disconnection Timer (seconds)",
+		Help:       "Seconds without poll after which users of this company are offline. Zero uses the global setting.",
+		Constraint: h.Company().Methods().CheckBusDisconnectionTimer()},
+}
+
+// presenceTimers holds the timers used to compute the status of a user
+type presenceTimers struct {
+	away          time.Duration
+	disconnection time.Duration
+}
+
+// globalPresenceTimers returns the timers defined in the settings
+func globalPresenceTimers(env models.Environment) presenceTimers {
+	res := presenceTimers{
+		away:          defaultAwayTimer,
+		disconnection: defaultDisconnectionTimer,
+	}
+	params := h.ConfigParameter().NewSet(env).Sudo()
+	if minutes, err := strconv.Atoi(params.GetParam(awayTimerParam, "")); err == nil && minutes > 0 {
+		res.away = time.Duration(minutes) * time.Minute
+	}
+	if seconds, err := strconv.Atoi(params.GetParam(disconnectionTimerParam, "")); err == nil && seconds > 0 {
+		res.disconnection = clampDisconnectionTimer(time.Duration(seconds) * time.Second)
+	}
+	return res
+}
+
+// clampDisconnectionTimer returns the given disconnection timer, or minDisconnectionTimer if it is lower.
+func clampDisconnectionTimer(timer time.Duration) time.Duration {
+	if timer < minDisconnectionTimer {
+		return minDisconnectionTimer
+	}
+	return timer
+}
+
+// checkDisconnectionTimer panics if the given number of seconds is a disconnection
+// timer lower than minDisconnectionTimer. Zero is allowed since it means the default.
+func checkDisconnectionTimer(rs models.RecordSet, seconds int64) {
+	if seconds != 0 && time.Duration(seconds)*time.Second < minDisconnectionTimer {
+		panic(rs.Collection().T("The disconnection timer must be at least %d seconds", int64(minDisconnectionTimer/time.Second)))
+	}
+}
+
+// usersPresenceTimers returns the presence timers of the given users by user ID.
+func usersPresenceTimers(users m.UserSet) map[int64]presenceTimers {
+	res := make(map[int64]presenceTimers)
+	if users.IsEmpty() {
+		return res
+	}
+	global := globalPresenceTimers(users.Env())
+	for _, user := range users.Sudo().Records() {
+		timers := global
+		company := user.Company()
+		if company.BusAwayTimer() > 0 {
+			timers.away = time.Duration(company.BusAwayTimer()) * time.Minute
+		}
+		if company.BusDisconnectionTimer() > 0 {
+			timers.disconnection = clampDisconnectionTimer(time.Duration(company.BusDisconnectionTimer()) * time.Second)
+		}
+		res[user.ID()] = timers
+	}
+	return res
+}
+
+// PresenceTimers returns the away and disconnection timers that apply to this user.
+func user_PresenceTimers(rs m.UserSet) bustypes.PresenceTimers {
+	rs.EnsureOne()
+	timers := usersPresenceTimers(rs)[rs.ID()]
+	return bustypes.PresenceTimers{
+		AwayTimer:          int64(timers.away / time.Second),
+		DisconnectionTimer: int64(timers.disconnection / time.Second),
+	}
+}
+
+// CheckBusDisconnectionTimer checks that the disconnection timer of these companies is not too low.
+func company_CheckBusDisconnectionTimer(rs m.CompanySet) {
+	for _, company := range rs.Records() {
+		checkDisconnectionTimer(company, company.BusDisconnectionTimer())
+	}
+}
+
+func init() {
+	h.Company().AddFields(fields_Company)
+	h.Company().NewMethod("CheckBusDisconnectionTimer", company_CheckBusDisconnectionTimer)
+
+	h.User().NewMethod("PresenceTimers", user_PresenceTimers)
+}
@@ -0,0 +1,59 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPresenceTimers(t *testing.T) {
+	Convey("Testing configurable presence timers", t, func() {
+		models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			company := h.Company().Create(env, h.Company().NewData().SetName("Call Centre"))
+			user := h.User().Create(env, h.User().NewData().
+				SetName("Timers User").
+				SetLogin("timers_user").
+				SetCompany(company).
+				SetCompanies(company))
+			h.BusPresence().Create(env, h.BusPresence().NewData().
+				SetUser(user).
+				SetLastPoll(dates.Now()).
+				SetLastPresence(dates.Now().Add(-10*time.Minute)))
+			Convey("Default timers apply if not configured", func() {
+				So(user.PresenceTimers().AwayTimer, ShouldEqual, 30*60)
+				So(user.IMStatus(), ShouldEqual, "online")
+			})
+			Convey("Global timers apply to all companies", func() {
+				h.ConfigParameter().NewSet(env).SetParam(awayTimerParam, "5")
+				So(user.PresenceTimers().AwayTimer, ShouldEqual, 5*60)
+				So(user.IMStatus(), ShouldEqual, "away")
+			})
+			Convey("Company timers override global timers", func() {
+				h.ConfigParameter().NewSet(env).SetParam(awayTimerParam, "5")
+				company.SetBusAwayTimer(60)
+				So(user.PresenceTimers().AwayTimer, ShouldEqual, 60*60)
+				So(user.IMStatus(), ShouldEqual, "online")
+				company.SetBusDisconnectionTimer(120)
+				So(user.PresenceTimers().DisconnectionTimer, ShouldEqual, 120)
+			})
+			Convey("Disconnection timers cannot be lower than a poll and a flush", func() {
+				minTimer := int64(minDisconnectionTimer / time.Second)
+				So(func() { company.SetBusDisconnectionTimer(1) }, ShouldPanic)
+				So(func() {
+					h.ConfigSettings().Create(env, h.ConfigSettings().NewData().SetBusDisconnectionTimer(1))
+				}, ShouldPanic)
+				h.ConfigParameter().NewSet(env).SetParam(disconnectionTimerParam, "1")
+				So(user.PresenceTimers().DisconnectionTimer, ShouldEqual, minTimer)
+				So(user.IMStatus(), ShouldEqual, "online")
+			})
+		})
+	})
+}
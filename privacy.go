@@ -0,0 +1,221 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"strings"
+
+	"github.com/hexya-addons/bus/bustypes"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
+)
+
+// privacyPollMiddlewareSequence is the sequence of the poll middleware that hides
+// the presence of users according to their privacy settings.
+const privacyPollMiddlewareSequence = 1000
+
+/* Presence Privacy
+Users choose in their BusPresenceSettings who can see their status: everyone, the
+users of their companies or nobody, and whether external (portal) users can see it.
+Users whose status cannot be seen appear offline, without status message, devices
+or last seen date.
+
+Users always see their own status and the superuser sees all statuses.
+*/
+
+// presenceVisibilities are the possible values of the PresenceVisibility setting
+var presenceVisibilities = types.Selection{
+	"everyone": "Everyone",
+	"company":  "My Companies",
+	"nobody":   "Nobody",
+}
+
+// presenceViewer is a user requesting the presence of other users
+type presenceViewer struct {
+	uid          int64
+	unrestricted bool
+	share        bool
+	companies    map[int64]bool
+}
+
+// newPresenceViewer returns the presenceViewer of the user of the given environment
+func newPresenceViewer(env models.Environment) *presenceViewer {
+	res := &presenceViewer{
+		uid:          env.Uid(),
+		unrestricted: env.Uid() == security.SuperUserID,
+		companies:    make(map[int64]bool),
+	}
+	if res.unrestricted {
+		return res
+	}
+	user := h.User().BrowseOne(env, env.Uid()).Sudo()
+	res.share = user.Share()
+	for _, id := range user.Companies().Ids() {
+		res.companies[id] = true
+	}
+	return res
+}
+
+// visibleUsers returns the IDs of the given users whose presence can be seen
+// by the user of the given environment.
+func visibleUsers(env models.Environment, users m.UserSet) map[int64]bool {
+	res := make(map[int64]bool)
+	for _, id := range users.Ids() {
+		res[id] = true
+	}
+	viewer := newPresenceViewer(env)
+	if viewer.unrestricted || users.IsEmpty() {
+		return res
+	}
+	settings := h.BusPresenceSettings().NewSet(env).Sudo().Search(q.BusPresenceSettings().User().In(users))
+	for _, setting := range settings.Records() {
+		user := setting.User()
+		if user.ID() == viewer.uid {
+			continue
+		}
+		switch {
+		case setting.PresenceVisibility() == "nobody":
+			res[user.ID()] = false
+		case setting.HideFromPortal() && viewer.share && !user.Share():
+			res[user.ID()] = false
+		case setting.PresenceVisibility() == "company":
+			res[user.ID()] = false
+			for _, companyID := range user.Companies().Ids() {
+				if viewer.companies[companyID] {
+					res[user.ID()] = true
+					break
+				}
+			}
+		}
+	}
+	return res
+}
+
+// filterVisibleUsers returns the users of the given set whose presence can be seen
+// by the user of its environment.
+func filterVisibleUsers(users m.UserSet) m.UserSet {
+	visible := visibleUsers(users.Env(), users)
+	res := h.User().NewSet(users.Env())
+	for _, user := range users.Records() {
+		if visible[user.ID()] {
+			res = res.Union(user)
+		}
+	}
+	return res
+}
+
+// IMLastSeen returns the last activity date of the users of this recordset who chose
+// to show it and whose presence can be seen by the current user, by user ID.
+func user_IMLastSeen(rs m.UserSet) map[int64]dates.DateTime {
+	res := make(map[int64]dates.DateTime)
+	if rs.IsEmpty() {
+		return res
+	}
+	visible := visibleUsers(rs.Env(), rs)
+	shown := h.User().NewSet(rs.Env())
+	settings := h.BusPresenceSettings().NewSet(rs.Env()).Sudo().Search(
+		q.BusPresenceSettings().User().In(rs).And().ShowLastSeen().Equals(true))
+	for _, setting := range settings.Records() {
+		if visible[setting.User().ID()] {
+			shown = shown.Union(setting.User())
+		}
+	}
+	for userID, devices := range usersDevices(shown) {
+		for _, device := range devices {
+			if device.LastPresence.Greater(res[userID]) {
+				res[userID] = device.LastPresence
+			}
+		}
+	}
+	return res
+}
+
+// IMLastSeen returns the last activity date of the partners of this recordset, by partner ID.
+//
+// The last activity date of a partner is the most recent of the ones of its users
+// returned by the users' IMLastSeen.
+func partner_IMLastSeen(rs m.PartnerSet) map[int64]dates.DateTime {
+	res := make(map[int64]dates.DateTime)
+	if rs.IsEmpty() {
+		return res
+	}
+	users := h.User().NewSet(rs.Env()).Sudo().Search(q.User().Partner().In(rs)).Load(q.User().Partner())
+	lastSeen := users.Sudo(rs.Env().Uid()).IMLastSeen()
+	for _, user := range users.Records() {
+		partnerID := user.Partner().ID()
+		if date, ok := lastSeen[user.ID()]; ok && date.Greater(res[partnerID]) {
+			res[partnerID] = date
+		}
+	}
+	return res
+}
+
+// SetPresencePrivacy sets the presence privacy settings of these users and publishes
+// their status so that it is updated for the users who can or cannot see it anymore.
+func user_SetPresencePrivacy(rs m.UserSet, visibility string, showLastSeen, hideFromPortal bool) {
+	if _, ok := presenceVisibilities[visibility]; !ok {
+		panic(rs.T("Unknown presence visibility: %s", visibility))
+	}
+	partners := h.Partner().NewSet(rs.Env())
+	for _, user := range rs.Records() {
+		values := h.BusPresenceSettings().NewData().
+			SetPresenceVisibility(visibility).
+			SetShowLastSeen(showLastSeen).
+			SetHideFromPortal(hideFromPortal)
+		setting := h.BusPresenceSettings().NewSet(rs.Env()).Sudo().Search(q.BusPresenceSettings().User().Equals(user))
+		if setting.IsEmpty() {
+			h.BusPresenceSettings().NewSet(rs.Env()).Sudo().Create(values.SetUser(user))
+		} else {
+			setting.Write(values)
+		}
+		partners = partners.Union(user.Partner())
+	}
+	publishPartnersStatus(partners)
+}
+
+// privacyPollMiddleware replaces the status published on the presence channels by
+// the status that the polling user can see.
+func privacyPollMiddleware(env models.Environment, notification *bustypes.Notification) []*bustypes.Notification {
+	if !strings.HasPrefix(notification.Channel, presenceChannelPrefix) {
+		return []*bustypes.Notification{notification}
+	}
+	message, ok := notification.Message.(map[string]interface{})
+	if !ok {
+		return []*bustypes.Notification{notification}
+	}
+	partnerID, ok := message["id"].(float64)
+	if !ok {
+		return []*bustypes.Notification{notification}
+	}
+	partner := h.Partner().BrowseOne(env, int64(partnerID))
+	users := h.User().NewSet(env).Sudo().Search(q.User().Partner().Equals(partner))
+	for _, visible := range visibleUsers(env, users) {
+		if visible {
+			continue
+		}
+		// At least one user is hidden, so we recompute the status as seen by this user
+		filtered := *notification
+		filteredMessage := make(map[string]interface{})
+		for k, v := range message {
+			filteredMessage[k] = v
+		}
+		filteredMessage["im_status"] = partner.IMStatuses()[partner.ID()]
+		filtered.Message = filteredMessage
+		return []*bustypes.Notification{&filtered}
+	}
+	return []*bustypes.Notification{notification}
+}
+
+func init() {
+	h.User().NewMethod("IMLastSeen", user_IMLastSeen)
+	h.User().NewMethod("SetPresencePrivacy", user_SetPresencePrivacy)
+	h.Partner().NewMethod("IMLastSeen", partner_IMLastSeen)
+
+	RegisterPollMiddleware(privacyPollMiddlewareSequence, privacyPollMiddleware)
+}
@@ -0,0 +1,115 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hexya-addons/base"
+	"github.com/hexya-addons/bus/bustypes"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPresencePrivacy(t *testing.T) {
+	Convey("Testing presence privacy", t, func() {
+		models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			employees := h.Group().Search(env, q.Group().GroupID().Equals(base.GroupUser.ID()))
+			portal := h.Group().Search(env, q.Group().GroupID().Equals(base.GroupPortal.ID()))
+			company := h.Company().Create(env, h.Company().NewData().SetName("Private Company"))
+			otherCompany := h.Company().Create(env, h.Company().NewData().SetName("Other Company"))
+			newUser := func(login string, comp m.CompanySet, groups m.GroupSet) m.UserSet {
+				return h.User().Create(env, h.User().NewData().
+					SetName(login).
+					SetLogin(login).
+					SetCompany(comp).
+					SetCompanies(comp).
+					SetGroups(groups))
+			}
+			user := newUser("private_user", company, employees)
+			coworker := newUser("private_coworker", company, employees)
+			outsider := newUser("private_outsider", otherCompany, employees)
+			customer := newUser("private_customer", company, portal)
+			h.BusPresence().Create(env, h.BusPresence().NewData().
+				SetUser(user).
+				SetLastPoll(dates.Now()).
+				SetLastPresence(dates.Now()))
+			statusSeenBy := func(viewer m.UserSet) string {
+				return user.Sudo(viewer.ID()).IMStatuses()[user.ID()]
+			}
+			partnerStatusSeenBy := func(viewer m.UserSet) string {
+				return user.Partner().Sudo(viewer.ID()).IMStatuses()[user.Partner().ID()]
+			}
+			Convey("Status is visible to everyone by default", func() {
+				So(statusSeenBy(outsider), ShouldEqual, "online")
+				So(statusSeenBy(customer), ShouldEqual, "online")
+			})
+			Convey("Status can be restricted to the user's companies", func() {
+				user.SetPresencePrivacy("company", false, false)
+				So(statusSeenBy(coworker), ShouldEqual, "online")
+				So(statusSeenBy(outsider), ShouldEqual, "offline")
+				So(partnerStatusSeenBy(outsider), ShouldEqual, "offline")
+			})
+			Convey("Status can be hidden to everyone but the user", func() {
+				user.SetPresenceStatus("busy", "Do not call", dates.DateTime{})
+				user.SetPresencePrivacy("nobody", false, false)
+				So(statusSeenBy(coworker), ShouldEqual, "offline")
+				So(user.Sudo(coworker.ID()).IMStatusMessages(), ShouldBeEmpty)
+				So(user.Sudo(coworker.ID()).IMDevices(), ShouldBeEmpty)
+				So(statusSeenBy(user), ShouldEqual, "busy")
+				results := h.Partner().NewSet(env).Sudo(coworker.ID()).SearchIMContacts(bustypes.IMSearchParams{Name: "private_user", Limit: 10})
+				So(results, ShouldHaveLength, 1)
+				So(results[0].IMStatus, ShouldEqual, "offline")
+			})
+			Convey("Status can be hidden to portal users", func() {
+				user.SetPresencePrivacy("everyone", false, true)
+				So(statusSeenBy(coworker), ShouldEqual, "online")
+				So(statusSeenBy(customer), ShouldEqual, "offline")
+			})
+			Convey("Last seen date is only exposed if the user chose so", func() {
+				So(user.Sudo(coworker.ID()).IMLastSeen(), ShouldBeEmpty)
+				user.SetPresencePrivacy("everyone", true, false)
+				So(user.Sudo(coworker.ID()).IMLastSeen(), ShouldContainKey, user.ID())
+				So(user.Partner().Sudo(coworker.ID()).IMLastSeen(), ShouldContainKey, user.Partner().ID())
+			})
+			Convey("Presence records are only accessible through the bus methods", func() {
+				for _, viewer := range []m.UserSet{coworker, customer} {
+					viewerEnv := h.User().NewSet(env).Sudo(viewer.ID()).Env()
+					So(func() { h.BusPresence().NewSet(viewerEnv).SearchAll().Load() }, ShouldPanic)
+					So(func() { h.BusPresenceSettings().NewSet(viewerEnv).SearchAll().Load() }, ShouldPanic)
+					So(func() { h.BusChannelListener().NewSet(viewerEnv).SearchAll().Load() }, ShouldPanic)
+				}
+				coworkerEnv := h.User().NewSet(env).Sudo(coworker.ID()).Env()
+				So(func() {
+					coworker.Sudo(coworker.ID()).SetPresencePrivacy("company", true, false)
+					coworker.Sudo(coworker.ID()).SetPresenceStatus("busy", "In a meeting", dates.DateTime{})
+					coworker.Sudo(coworker.ID()).Snooze(dates.Now().Add(time.Hour))
+					h.BusPresence().NewSet(coworkerEnv).Disconnect("")
+				}, ShouldNotPanic)
+				settings := h.BusPresenceSettings().Search(env, q.BusPresenceSettings().User().Equals(coworker))
+				So(settings.PresenceVisibility(), ShouldEqual, "company")
+				So(settings.ManualStatus(), ShouldEqual, "busy")
+			})
+			Convey("Presence notifications are filtered for the polling user", func() {
+				user.SetPresencePrivacy("nobody", false, false)
+				notif := &bustypes.Notification{
+					Channel: PresenceChannel(user.Partner().ID()),
+					Message: map[string]interface{}{"id": float64(user.Partner().ID()), "im_status": "online"},
+				}
+				coworkerEnv := h.User().NewSet(env).Sudo(coworker.ID()).Env()
+				res := privacyPollMiddleware(coworkerEnv, notif)
+				So(res[0].Message.(map[string]interface{})["im_status"], ShouldEqual, "offline")
+				So(notif.Message.(map[string]interface{})["im_status"], ShouldEqual, "online")
+				userEnv := h.User().NewSet(env).Sudo(user.ID()).Env()
+				So(privacyPollMiddleware(userEnv, notif)[0], ShouldEqual, notif)
+			})
+		})
+	})
+}
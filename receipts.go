@@ -0,0 +1,232 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hexya-addons/bus/bustypes"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/fields"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
+)
+
+const (
+	// receiptMessageType is the message type of the receipt updates sent to senders
+	receiptMessageType = "bus.receipt"
+	// receiptRetention is the duration during which notifications requiring an acknowledgement
+	// and their receipts are kept
+	receiptRetention = 7 * 24 * time.Hour
+)
+
+/* Delivery and Read Receipts
+Notifications sent with the RequireAck flag are acknowledged by the clients of their
+recipients: on the next poll for the delivery (with the 'bus_ack' poll option) and
+through the ack endpoint for the delivery or the reading.
+
+Each acknowledging user gets a BusReceipt with its delivery and read dates. Senders
+can query the receipts of a notification with BusBus' Receipts method, register a
+ReceiptHandler with OnReceipt, or listen to the updates sent on their UserChannel as
+{type: 'bus.receipt', receipt: Receipt}.
+
+Notifications requiring an acknowledgement are kept for receiptRetention instead of
+being removed after two poll timeouts.
+*/
+
+var fields_BusReceipt = map[string]models.FieldDefinition{
+	"Notification": fields.Many2One{
+		RelationModel: h.BusBus(),
+		Required:      true,
+		Index:         true,
+		OnDelete:      `cascade`},
+
+	"User": fields.Many2One{
+		RelationModel: h.User(),
+		Required:      true,
+		Index:         true,
+		OnDelete:      `cascade`},
+
+	"DeliveryDate": fields.DateTime{
+		String: "Delivered On"},
+
+	"ReadDate": fields.DateTime{
+		String: "Read On"},
+}
+
+// A ReceiptHandler is called when a user acknowledges the delivery or the reading
+// of a notification that requires it.
+//
+// Handlers are called synchronously in the environment of the acknowledging user.
+// Their panics are logged and do not prevent the other handlers from being called.
+type ReceiptHandler func(env models.Environment, receipt bustypes.Receipt)
+
+// receiptHandlers holds the handlers registered with OnReceipt
+var receiptHandlers struct {
+	sync.RWMutex
+	handlers []ReceiptHandler
+}
+
+// OnReceipt registers the given handler to be called on each new or updated receipt.
+func OnReceipt(handler ReceiptHandler) {
+	receiptHandlers.Lock()
+	defer receiptHandlers.Unlock()
+	receiptHandlers.handlers = append(receiptHandlers.handlers, handler)
+}
+
+// fireReceipts calls the registered ReceiptHandler for each of the given receipts
+func fireReceipts(env models.Environment, receipts []bustypes.Receipt) {
+	receiptHandlers.RLock()
+	defer receiptHandlers.RUnlock()
+	for _, receipt := range receipts {
+		for _, handler := range receiptHandlers.handlers {
+			callReceiptHandler(handler, env, receipt)
+		}
+	}
+}
+
+// callReceiptHandler calls the given handler, logging its panic if any
+func callReceiptHandler(handler ReceiptHandler, env models.Environment, receipt bustypes.Receipt) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Warn("Receipt handler failed", "notification", receipt.NotificationID, "user", receipt.UserID, "error", r)
+		}
+	}()
+	handler(env, receipt)
+}
+
+// ToReceipt returns the Receipt of this receipt record
+func busReceipt_ToReceipt(rs m.BusReceiptSet) bustypes.Receipt {
+	rs.EnsureOne()
+	res := bustypes.Receipt{
+		NotificationID: rs.Notification().ID(),
+		UserID:         rs.User().ID(),
+		PartnerID:      rs.User().Partner().ID(),
+		DeliveryDate:   rs.DeliveryDate(),
+	}
+	if !rs.ReadDate().IsZero() {
+		readDate := rs.ReadDate()
+		res.ReadDate = &readDate
+	}
+	return res
+}
+
+// Acknowledge records that the current user received these notifications, and read
+// them if read is true. Notifications that do not require an acknowledgement or that
+// are sent on channels the current user may not poll are ignored.
+//
+// Senders are notified of the new and updated receipts.
+func busBus_Acknowledge(rs m.BusBusSet, read bool) {
+	if rs.IsEmpty() {
+		return
+	}
+	notifications := h.BusBus().NewSet(rs.Env()).Sudo().Search(
+		q.BusBus().ID().In(rs.Ids()).And().RequireAck().Equals(true))
+	if notifications.IsEmpty() {
+		return
+	}
+	user := h.User().BrowseOne(rs.Env(), rs.Env().Uid())
+	existing := make(map[int64]m.BusReceiptSet)
+	receipts := h.BusReceipt().NewSet(rs.Env()).Sudo().Search(
+		q.BusReceipt().Notification().In(notifications).And().User().Equals(user))
+	for _, receipt := range receipts.Records() {
+		existing[receipt.Notification().ID()] = receipt
+	}
+	now := dates.Now()
+	var (
+		changed []bustypes.Receipt
+		updates []*bustypes.Notification
+	)
+	for _, notification := range notifications.Records() {
+		if !mayPollChannel(user.ID(), notification.Channel()) {
+			continue
+		}
+		receipt, ok := existing[notification.ID()]
+		switch {
+		case !ok:
+			values := h.BusReceipt().NewData().
+				SetNotification(notification).
+				SetUser(user).
+				SetDeliveryDate(now)
+			if read {
+				values.SetReadDate(now)
+			}
+			receipt = h.BusReceipt().NewSet(rs.Env()).Sudo().Create(values)
+		case read && receipt.ReadDate().IsZero():
+			receipt.SetReadDate(now)
+		default:
+			continue
+		}
+		value := receipt.ToReceipt()
+		changed = append(changed, value)
+		if !notification.Sender().IsEmpty() {
+			updates = append(updates, &bustypes.Notification{
+				Channel: UserChannel(notification.Sender().ID()),
+				Message: map[string]interface{}{
+					"type":    receiptMessageType,
+					"receipt": value,
+				},
+				MessageType: receiptMessageType,
+			})
+		}
+	}
+	if len(updates) > 0 {
+		if err := h.BusBus().NewSet(rs.Env()).SendmanyE(updates); err != nil {
+			log.Warn("Unable to publish receipts", "error", err)
+		}
+	}
+	fireReceipts(rs.Env(), changed)
+}
+
+// Receipts returns the receipts of this notification, ordered by delivery date.
+func busBus_Receipts(rs m.BusBusSet) []bustypes.Receipt {
+	rs.EnsureOne()
+	receipts := h.BusReceipt().NewSet(rs.Env()).Sudo().Search(
+		q.BusReceipt().Notification().Equals(rs)).OrderBy("DeliveryDate", "ID")
+	res := []bustypes.Receipt{}
+	for _, receipt := range receipts.Records() {
+		res = append(res, receipt.ToReceipt())
+	}
+	return res
+}
+
+// ackOption returns the IDs of the notifications acknowledged in the given poll options
+func ackOption(options *types.Context) []int64 {
+	switch values := options.Get("bus_ack").(type) {
+	case []int64:
+		return values
+	case []interface{}:
+		var res []int64
+		for _, value := range values {
+			if id, ok := value.(float64); ok {
+				res = append(res, int64(id))
+			}
+		}
+		return res
+	}
+	return nil
+}
+
+// acknowledgeNotifications records that the user with the given uid received
+// the notifications with the given IDs.
+func acknowledgeNotifications(uid int64, ids []int64) error {
+	return models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		h.BusBus().Browse(env, ids).Acknowledge(false)
+	})
+}
+
+func init() {
+	models.NewModel("BusReceipt")
+	h.BusReceipt().AddFields(fields_BusReceipt)
+	h.BusReceipt().NewMethod("ToReceipt", busReceipt_ToReceipt)
+	h.BusReceipt().AddSQLConstraint("notification_user_uniq", "unique(notification_id, user_id)",
+		"A user can only have one receipt per notification")
+
+	h.BusBus().NewMethod("Acknowledge", busBus_Acknowledge)
+	h.BusBus().NewMethod("Receipts", busBus_Receipts)
+}
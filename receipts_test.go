@@ -0,0 +1,97 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"testing"
+
+	"github.com/hexya-addons/bus/bustypes"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/q"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestReceipts(t *testing.T) {
+	Convey("Testing delivery and read receipts", t, func() {
+		receiptHandlers.RLock()
+		handlers := receiptHandlers.handlers
+		receiptHandlers.RUnlock()
+		var handled []bustypes.Receipt
+		OnReceipt(func(env models.Environment, receipt bustypes.Receipt) {
+			handled = append(handled, receipt)
+		})
+		models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			// Notifications are stored in their own transaction, so their senders must be committed users
+			sender := h.User().BrowseOne(env, security.SuperUserID)
+			recipient := h.User().Search(env, q.User().Login().Equals("admin"))
+			critical := &bustypes.Notification{
+				Channel:    "receipts.critical",
+				Message:    "Stock shortage on your order",
+				SenderID:   sender.ID(),
+				RequireAck: true,
+			}
+			normal := &bustypes.Notification{
+				Channel: "receipts.critical",
+				Message: "Nothing important",
+			}
+			So(h.BusBus().NewSet(env).SendmanyE([]*bustypes.Notification{critical, normal}), ShouldBeNil)
+			So(critical.ID, ShouldNotEqual, 0)
+			notification := h.BusBus().BrowseOne(env, critical.ID)
+			recipientBus := h.BusBus().NewSet(env).Sudo(recipient.ID())
+			Convey("Only notifications requiring it can be acknowledged", func() {
+				recipientBus.Browse([]int64{critical.ID, normal.ID}).Acknowledge(false)
+				So(h.BusBus().BrowseOne(env, normal.ID).Receipts(), ShouldBeEmpty)
+				receipts := notification.Receipts()
+				So(receipts, ShouldHaveLength, 1)
+				So(receipts[0].UserID, ShouldEqual, recipient.ID())
+				So(receipts[0].DeliveryDate.IsZero(), ShouldBeFalse)
+				So(receipts[0].ReadDate, ShouldBeNil)
+				So(handled, ShouldHaveLength, 1)
+			})
+			Convey("Notifications of channels the user may not poll cannot be acknowledged", func() {
+				private := &bustypes.Notification{
+					Channel:    UserChannel(987654),
+					Message:    "Not for you",
+					SenderID:   sender.ID(),
+					RequireAck: true,
+				}
+				So(h.BusBus().NewSet(env).SendmanyE([]*bustypes.Notification{private}), ShouldBeNil)
+				recipientBus.Browse([]int64{private.ID}).Acknowledge(true)
+				So(h.BusBus().BrowseOne(env, private.ID).Receipts(), ShouldBeEmpty)
+				So(handled, ShouldBeEmpty)
+			})
+			Convey("Reading is recorded once and notified to the sender", func() {
+				recipientBus.Browse([]int64{critical.ID}).Acknowledge(true)
+				recipientBus.Browse([]int64{critical.ID}).Acknowledge(true)
+				recipientBus.Browse([]int64{critical.ID}).Acknowledge(false)
+				receipts := notification.Receipts()
+				So(receipts, ShouldHaveLength, 1)
+				So(receipts[0].ReadDate, ShouldNotBeNil)
+				So(handled, ShouldHaveLength, 1)
+				var updates int
+				for _, notif := range h.BusBus().NewSet(env).Poll([]string{UserChannel(sender.ID())}, critical.ID, types.NewContext(), false) {
+					if notif.MessageType == receiptMessageType {
+						updates++
+					}
+				}
+				So(updates, ShouldEqual, 1)
+			})
+			Convey("Polled notifications carry the acknowledgement flag", func() {
+				notifs := h.BusBus().NewSet(env).Poll([]string{"receipts.critical"}, critical.ID-1, types.NewContext(), false)
+				So(notifs, ShouldHaveLength, 2)
+				So(notifs[0].RequireAck, ShouldBeTrue)
+				So(notifs[1].RequireAck, ShouldBeFalse)
+				So(ackOption(types.NewContext().WithKey("bus_ack", []interface{}{float64(critical.ID)})), ShouldResemble, []int64{critical.ID})
+			})
+		})
+		Reset(func() {
+			receiptHandlers.Lock()
+			receiptHandlers.handlers = handlers
+			receiptHandlers.Unlock()
+		})
+	})
+}
@@ -6,6 +6,16 @@ import (
 )
 
 func init() {
-	h.BusPresence().Methods().AllowAllToGroup(base.GroupUser)
-	h.BusPresence().Methods().AllowAllToGroup(base.GroupPortal)
+	// Presences, presence settings and channel listeners hold the raw activity and
+	// privacy data of all users. Users only access them through the bus methods.
+	h.BusPresence().Methods().AllowAllToGroup(base.GroupSystem)
+	h.BusPresenceSettings().Methods().AllowAllToGroup(base.GroupSystem)
+	h.BusAudit().Methods().AllowAllToGroup(base.GroupSystem)
+	h.BusPresenceHistory().Methods().AllowAllToGroup(base.GroupSystem)
+	h.BusPresenceDaily().Methods().AllowAllToGroup(base.GroupSystem)
+	h.BusChannelListener().Methods().AllowAllToGroup(base.GroupSystem)
+	h.BusReceipt().Methods().AllowAllToGroup(base.GroupSystem)
+	h.BusUserNotification().Methods().AllowAllToGroup(base.GroupSystem)
+	h.BusGuest().Methods().Load().AllowGroup(base.GroupUser)
+	h.BusGuest().Methods().AllowAllToGroup(base.GroupSystem)
 }
@@ -17,10 +17,15 @@ var ServicesMixin = require('web.ServicesMixin');
 var LongpollingBus = Bus.extend(ServicesMixin, {
     // constants
     PARTNERS_PRESENCE_CHECK_PERIOD: 30000,  // don't check presence more than once every 30s
+    PRESENCE_CHANNEL_PREFIX: 'bus.presence.',
+    LISTENERS_CHANNEL_SUFFIX: '/listeners',
     ERROR_RETRY_DELAY: 10000, // 10 seconds
     POLL_ROUTE: '/longpolling/poll',
+    ACK_ROUTE: '/longpolling/ack',
+    PRESENCE_TIMERS_ROUTE: '/longpolling/presence_timers',
 
     // properties
+    _awayTimer: 30 * 60 * 1000, // overridden by the server configuration
     _isActive: null,
     _lastNotificationID: 0,
     _isHexyaFocused: true,
@@ -37,6 +42,8 @@ var LongpollingBus = Bus.extend(ServicesMixin, {
         this._longPollingBusId = this._id;
         this._options = {};
         this._channels = [];
+        // IDs of the received notifications requiring an acknowledgement, sent with the next poll
+        this._pendingAcks = [];
 
         // bus presence
         this._lastPresenceTime = new Date().getTime();
@@ -82,6 +89,71 @@ var LongpollingBus = Bus.extend(ServicesMixin, {
             }
         }
     },
+    /**
+     * Start listening to the status changes of the given partners.
+     * Changes are received as notifications on each partner's presence channel
+     * with a message of the form {id: partnerID, im_status: status}.
+     *
+     * @param {integer[]} partnerIDs
+     */
+    addPartnersPresence: function (partnerIDs) {
+        var self = this;
+        _.each(partnerIDs, function (partnerID) {
+            self.addChannel(self.PRESENCE_CHANNEL_PREFIX + partnerID);
+        });
+    },
+    /**
+     * Stop listening to the status changes of the given partners.
+     *
+     * @param {integer[]} partnerIDs
+     */
+    deletePartnersPresence: function (partnerIDs) {
+        var self = this;
+        _.each(partnerIDs, function (partnerID) {
+            self.deleteChannel(self.PRESENCE_CHANNEL_PREFIX + partnerID);
+        });
+    },
+    /**
+     * Set the metadata of this connection on the given channel, such as
+     * {mode: 'editing'}. It is sent to the server with the next poll, which is
+     * restarted immediately, and published to the other listeners of the channel.
+     *
+     * @param {string} channel
+     * @param {Object|null} metadata null to remove the metadata
+     */
+    setChannelMetadata: function (channel, metadata) {
+        var channelsMetadata = _.extend({}, this._options.bus_channel_metadata);
+        if (metadata) {
+            channelsMetadata[channel] = metadata;
+        } else {
+            delete channelsMetadata[channel];
+        }
+        this.updateOption('bus_channel_metadata', channelsMetadata);
+        if (this._pollRpc) {
+            this._pollRpc.abort();
+        }
+    },
+    /**
+     * Start listening to the changes of the listeners of the given channel.
+     * They are received as notifications on the channel suffixed by
+     * LISTENERS_CHANNEL_SUFFIX with a message of the form
+     * {type: 'bus.listeners', channel: channel, joined: [], updated: [], left: []}.
+     *
+     * @param {string} channel
+     * @returns {Promise} resolved with the current listeners of the channel
+     */
+    addChannelListeners: function (channel) {
+        this.addChannel(channel + this.LISTENERS_CHANNEL_SUFFIX);
+        return this._rpc({route: '/longpolling/listeners', params: {channel: channel}}, {shadow: true});
+    },
+    /**
+     * Stop listening to the changes of the listeners of the given channel.
+     *
+     * @param {string} channel
+     */
+    deleteChannelListeners: function (channel) {
+        this.deleteChannel(channel + this.LISTENERS_CHANNEL_SUFFIX);
+    },
     /**
      * Unregister a channel from listening on the longpoll.
      *
@@ -100,6 +172,16 @@ var LongpollingBus = Bus.extend(ServicesMixin, {
             }
         }
     },
+    /**
+     * Acknowledge the reading of the given notifications by the user. Only
+     * notifications sent with require_ack are taken into account by the server.
+     *
+     * @param {integer[]} notificationIDs
+     * @returns {Promise}
+     */
+    markRead: function (notificationIDs) {
+        return this._rpc({route: this.ACK_ROUTE, params: {read: notificationIDs}}, {shadow: true});
+    },
     /**
      * Tell whether hexya is focused or not
      *
@@ -113,8 +195,12 @@ var LongpollingBus = Bus.extend(ServicesMixin, {
      * connection as long as it is not stopped (@see `stopPolling`)
      */
     startPolling: function () {
+        var self = this;
         if (this._isActive === null) {
             this._poll = this._poll.bind(this);
+            this._rpc({route: this.PRESENCE_TIMERS_ROUTE}, {shadow: true}).then(function (timers) {
+                self._awayTimer = timers.away_timer * 1000;
+            });
         }
         if (!this._isActive) {
             this._isActive = true;
@@ -180,6 +266,11 @@ var LongpollingBus = Bus.extend(ServicesMixin, {
         var options = _.extend({}, this._options, {
             bus_inactivity: now - this._getLastPresence(),
         });
+        var acks = this._pendingAcks;
+        this._pendingAcks = [];
+        if (acks.length) {
+            options.bus_ack = acks;
+        }
         var data = {channels: this._channels, last: this._lastNotificationID, options: options};
         // The backend has a maximum cycle time of 50 seconds so give +10 seconds
         this._pollRpc = this._makePoll(data);
@@ -189,6 +280,8 @@ var LongpollingBus = Bus.extend(ServicesMixin, {
             self._poll();
         }).guardedCatch(function (result) {
             self._pollRpc = false;
+            // acknowledgements are sent again with the next poll
+            self._pendingAcks = acks.concat(self._pendingAcks);
             // no error popup if request is interrupted or fails for any reason
             result.event.preventDefault();
             if (result.message === "XmlHttpRequestError abort") {
@@ -228,12 +321,15 @@ var LongpollingBus = Bus.extend(ServicesMixin, {
     },
     /**
      * Handler when the long polling receive the new notifications
-     * Update the last notification id received.
-     * Triggered the 'notification' event with a list [channel, message] from notifications.
+     * Update the last notification id received and queue the acknowledgement
+     * of the notifications that require it.
+     * Triggered the 'notification' event with a list [channel, message, alert] from notifications.
+     * alert is false for the notifications that must not show a popup, e.g. the ones
+     * deferred by the server while the user is in do not disturb.
      *
      * @private
-     * @param {Object[]} notifications, Input notifications have an id, channel, message
-     * @returns {Array[]} Output arrays have notification's channel and message
+     * @param {Object[]} notifications, Input notifications have an id, channel, message and alert flag
+     * @returns {Array[]} Output arrays have notification's channel, message and alert flag
      */
     _onPoll: function (notifications) {
         var self = this;
@@ -241,7 +337,10 @@ var LongpollingBus = Bus.extend(ServicesMixin, {
             if (notif.id > self._lastNotificationID) {
                 self._lastNotificationID = notif.id;
             }
-            return [notif.channel, notif.message];
+            if (notif.require_ack) {
+                self._pendingAcks.push(notif.id);
+            }
+            return [notif.channel, notif.message, !!notif.alert];
         });
         this.trigger("notification", notifs);
         return notifs;
@@ -250,10 +349,18 @@ var LongpollingBus = Bus.extend(ServicesMixin, {
      * Handler when they are an activity on the window (click, keydown, keyup)
      * Update the last presence date.
      *
+     * If the user was inactive for longer than the away timer, the pending poll is
+     * restarted so that the server immediately gets the new bus_inactivity.
+     *
      * @private
      */
     _onPresence: function () {
-        this._lastPresenceTime = new Date().getTime();
+        var now = new Date().getTime();
+        var wasAway = now - this._getLastPresence() > this._awayTimer;
+        this._lastPresenceTime = now;
+        if (wasAway && this._pollRpc) {
+            this._pollRpc.abort();
+        }
     },
 });
 
@@ -5,11 +5,17 @@ var CrossTab = require('bus.CrossTab');
 var core = require('web.core');
 var ServicesMixin = require('web.ServicesMixin');
 
+var _t = core._t;
+
 var BusService =  CrossTab.extend(ServicesMixin, {
     dependencies : ['local_storage'],
 
+    // constants
+    USER_CHANNEL_PREFIX: 'bus.user.',
+
     // properties
     _audio: null,
+    _dndActive: false,
 
     /**
      * This method is necessary in order for this Class to be used to instantiate services
@@ -17,26 +23,58 @@ var BusService =  CrossTab.extend(ServicesMixin, {
      * @abstract
      */
     start: function () {},
+    /**
+     * Listen to the current user's channel to follow its do not disturb state
+     * and receive the digest of the alerts deferred while it was active.
+     *
+     * @override
+     */
+    startPolling: function () {
+        var self = this;
+        var uid = this.getSession().uid;
+        if (uid && !this._userChannel) {
+            this._userChannel = this.USER_CHANNEL_PREFIX + uid;
+            this._channels.push(this._userChannel);
+            this.onNotification(this, this._onUserNotification);
+            this._rpc({
+                route: '/longpolling/im_status',
+                params: {user_ids: [uid]},
+            }, {shadow: true}).then(function (result) {
+                self._dndActive = _.some(result.users, {im_status: 'dnd'});
+            });
+        }
+        this._super.apply(this, arguments);
+    },
 
     //--------------------------------------------------------------------------
     // Public
     //--------------------------------------------------------------------------
 
     /**
-     * Send a notification, and notify once per browser's tab
+     * @returns {boolean} true if the current user is in do not disturb
+     */
+    isDNDActive: function () {
+        return this._dndActive;
+    },
+    /**
+     * Send a notification, and notify once per browser's tab.
      *
      * @param {string} title
      * @param {string} content
      * @param {function} [callback] if given callback will be called when user clicks on notification
+     * @param {Object} [options]
+     * @param {string} [options.icon] URL of the icon of the native notification
+     * @param {boolean} [options.sound=true] if false, no sound is played
      */
-    sendNotification: function (title, content, callback) {
+    sendNotification: function (title, content, callback, options) {
+        options = options || {};
         if (window.Notification && Notification.permission === "granted") {
             if (this.isMasterTab()) {
-                this._sendNativeNotification(title, content, callback);
+                this._sendNativeNotification(title, content, callback, options.icon);
             }
         } else {
             this.do_notify(title, content);
-            if (this.isMasterTab()) {
+            if (this.isMasterTab() && options.sound !== false) {
                 this._beep();
             }
         }
@@ -71,6 +109,69 @@ var BusService =  CrossTab.extend(ServicesMixin, {
             Promise.resolve(this._audio.play()).catch(_.noop);
         }
     },
+    /**
+     * Handle the notifications received on the current user's channel.
+     *
+     * Desktop notifications are only shown if they are received with the alert flag,
+     * which the server removes while the user is in do not disturb.
+     *
+     * @private
+     * @param {Array[]} notifications list of [channel, message, alert]
+     */
+    _onUserNotification: function (notifications) {
+        var self = this;
+        _.each(notifications, function (notif) {
+            var message = notif[1];
+            if (notif[0] !== self._userChannel || !message) {
+                return;
+            }
+            if (message.type === 'bus.dnd') {
+                self._dndActive = message.active;
+            } else if (message.type === 'bus.desktop_notification' && notif[2]) {
+                self._onDesktopNotification(message.notification);
+            } else if (message.type === 'bus.digest' && message.notifications.length) {
+                self.sendNotification(
+                    _t("While you were away"),
+                    _.str.sprintf(_t("You received %s notifications during do not disturb."), message.notifications.length)
+                );
+            }
+        });
+    },
+    /**
+     * Show a desktop notification sent by the server
+     *
+     * @private
+     * @param {Object} notification
+     * @param {string} notification.title
+     * @param {string} notification.body
+     * @param {string} [notification.icon]
+     * @param {boolean} notification.sound
+     * @param {Object} [notification.click_action] record (res_model, res_id) or window action to open on click
+     */
+    _onDesktopNotification: function (notification) {
+        var self = this;
+        var clickAction = notification.click_action;
+        var callback;
+        if (clickAction && clickAction.action) {
+            callback = function () {
+                self.do_action(clickAction.action);
+            };
+        } else if (clickAction && clickAction.res_model) {
+            callback = function () {
+                self.do_action({
+                    type: 'ir.actions.act_window',
+                    res_model: clickAction.res_model,
+                    res_id: clickAction.res_id,
+                    views: [[false, 'form']],
+                    target: 'current',
+                });
+            };
+        }
+        this.sendNotification(notification.title, notification.body, callback, {
+            icon: notification.icon,
+            sound: notification.sound,
+        });
+    },
     /**
      * Show a browser notification
      *
@@ -78,9 +179,10 @@ var BusService =  CrossTab.extend(ServicesMixin, {
      * @param {string} title
      * @param {string} content
      * @param {function} [callback] if given callback will be called when user clicks on notification
+     * @param {string} [icon] URL of the icon of the notification
      */
-    _sendNativeNotification: function (title, content, callback) {
-        var notification = new Notification(title, {body: content, icon: "/static/mail/src/img/hexyabot_transparent.png"});
+    _sendNativeNotification: function (title, content, callback, icon) {
+        var notification = new Notification(title, {body: content, icon: icon || "/static/mail/src/img/hexyabot_transparent.png"});
         notification.onclick = function () {
             window.focus();
             if (this.cancel) {
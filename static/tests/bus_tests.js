@@ -66,14 +66,15 @@ QUnit.module('Bus', {
             id: 2,
             channel: 'lambda',
             message: 'epsilon',
+            alert: true,
         }]);
         await testUtils.nextTick();
 
         assert.verifySteps([
             '/longpolling/poll - lambda',
-            'notification - lambda,beta',
+            'notification - lambda,beta,false',
             '/longpolling/poll - lambda',
-            'notification - lambda,epsilon',
+            'notification - lambda,epsilon,true',
             '/longpolling/poll - lambda',
         ]);
 
@@ -204,8 +205,8 @@ QUnit.module('Bus', {
 
         assert.verifySteps([
             'master - /longpolling/poll - lambda',
-            'master - notification - lambda,beta',
-            'slave - notification - lambda,beta',
+            'master - notification - lambda,beta,false',
+            'slave - notification - lambda,beta,false',
             'master - /longpolling/poll - lambda',
         ]);
 
@@ -299,11 +300,11 @@ QUnit.module('Bus', {
 
         assert.verifySteps([
             'master - /longpolling/poll - lambda',
-            'master - notification - lambda,beta',
-            'slave - notification - lambda,beta',
+            'master - notification - lambda,beta,false',
+            'slave - notification - lambda,beta,false',
             'master - /longpolling/poll - lambda',
             'slave - /longpolling/poll - lambda',
-            'slave - notification - lambda,gamma',
+            'slave - notification - lambda,gamma,false',
             'slave - /longpolling/poll - lambda',
         ]);
 
@@ -1,13 +1,14 @@
 package bus
 
 import (
-	"time"
-
+	"github.com/hexya-addons/base"
+	"github.com/hexya-addons/bus/bustypes"
 	"github.com/hexya-erp/hexya/src/models"
 	"github.com/hexya-erp/hexya/src/models/fields"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
 	"github.com/hexya-erp/pool/h"
 	"github.com/hexya-erp/pool/m"
-	"github.com/hexya-erp/pool/q"
 )
 
 var fields_User = map[string]models.FieldDefinition{
@@ -17,15 +18,48 @@ var fields_User = map[string]models.FieldDefinition{
 
 //  Compute the im_status of the users
 func user_ComputeIMStatus(rs m.UserSet) m.UserData {
-	presence := h.BusPresence().Search(rs.Env(), q.BusPresence().User().Equals(rs)).Limit(1)
-	res := h.User().NewData().SetIMStatus("offline")
-	switch {
-	case time.Since(presence.LastPoll().Time) > disconnectionTimer:
-		res.SetIMStatus("offline")
-	case time.Since(presence.LastPresence().Time) > awayTimer:
-		res.SetIMStatus("away")
-	default:
-		res.SetIMStatus("online")
+	return h.User().NewData().SetIMStatus(rs.IMStatuses()[rs.ID()])
+}
+
+// IMStatuses returns the IM status of each user of this recordset, by user ID.
+//
+// Users whose presence cannot be seen by the current user are offline.
+// Use this method instead of reading IMStatus on each record when dealing with several users.
+func user_IMStatuses(rs m.UserSet) map[int64]string {
+	res := usersStatuses(rs)
+	for userID, visible := range visibleUsers(rs.Env(), rs) {
+		if !visible {
+			res[userID] = "offline"
+		}
+	}
+	return res
+}
+
+// IMDevices returns the presence of each device of the users of this recordset, by user ID.
+// Devices are sorted most recently polled first.
+//
+// Devices of users whose presence cannot be seen by the current user are not returned.
+// Device keys are only returned to their user. Only the type and status of the devices
+// of other users are returned, unless the current user is a system user.
+func user_IMDevices(rs m.UserSet) map[int64][]bustypes.DevicePresence {
+	uid := rs.Env().Uid()
+	system := uid == security.SuperUserID || security.Registry.HasMembership(uid, base.GroupSystem)
+	visible := visibleUsers(rs.Env(), rs)
+	res := usersDevices(rs)
+	for userID, devices := range res {
+		switch {
+		case !visible[userID]:
+			delete(res, userID)
+		case userID != uid:
+			for i := range devices {
+				devices[i].Key = ""
+				if !system {
+					devices[i].UserAgent = ""
+					devices[i].LastPoll = dates.DateTime{}
+					devices[i].LastPresence = dates.DateTime{}
+				}
+			}
+		}
 	}
 	return res
 }
@@ -33,4 +67,6 @@ func user_ComputeIMStatus(rs m.UserSet) m.UserData {
 func init() {
 	h.User().AddFields(fields_User)
 	h.User().NewMethod("ComputeIMStatus", user_ComputeIMStatus)
+	h.User().NewMethod("IMStatuses", user_IMStatuses)
+	h.User().NewMethod("IMDevices", user_IMDevices)
 }
@@ -0,0 +1,105 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// defaultMaxMessageSize is the maximum size of a JSON encoded message on channels
+// that have no more specific rule.
+const defaultMaxMessageSize = 1 << 20
+
+var (
+	// ErrMessageTooLarge is returned when a message exceeds the maximum size of its channel.
+	ErrMessageTooLarge = errors.New("message too large")
+	// ErrInvalidMessage is returned when a message does not validate the JSON Schema of its channel.
+	ErrInvalidMessage = errors.New("invalid message")
+)
+
+// A ChannelRule defines the constraints that the messages sent on a channel must satisfy.
+type ChannelRule struct {
+	// MaxSize is the maximum size in bytes of the JSON encoded message.
+	// Zero means no limit.
+	MaxSize int
+	// Schema is an optional JSON Schema that the message must validate.
+	Schema string
+	schema *gojsonschema.Schema
+}
+
+// channelRules holds the registered ChannelRule instances by channel prefix
+var channelRules = struct {
+	sync.RWMutex
+	rules map[string]*ChannelRule
+}{
+	rules: map[string]*ChannelRule{
+		"": {MaxSize: defaultMaxMessageSize},
+	},
+}
+
+// RegisterChannelRule registers the given rule for all channels starting with prefix.
+// When several prefixes match a channel, the rule with the longest prefix applies.
+// Registering a rule with an empty prefix overrides the default rule.
+//
+// It panics if the rule's Schema is not a valid JSON Schema.
+func RegisterChannelRule(prefix string, rule ChannelRule) {
+	if rule.Schema != "" {
+		schema, err := gojsonschema.NewSchema(gojsonschema.NewStringLoader(rule.Schema))
+		if err != nil {
+			panic(fmt.Errorf("invalid JSON Schema for channel prefix '%s': %s", prefix, err))
+		}
+		rule.schema = schema
+	}
+	channelRules.Lock()
+	defer channelRules.Unlock()
+	channelRules.rules[prefix] = &rule
+}
+
+// getChannelRule returns the rule that applies to the given channel, or nil if there is none.
+func getChannelRule(channel string) *ChannelRule {
+	channelRules.RLock()
+	defer channelRules.RUnlock()
+	var (
+		res    *ChannelRule
+		length = -1
+	)
+	for prefix, rule := range channelRules.rules {
+		if strings.HasPrefix(channel, prefix) && len(prefix) > length {
+			res = rule
+			length = len(prefix)
+		}
+	}
+	return res
+}
+
+// validateMessage checks that the given JSON encoded message satisfies the rule of the given channel.
+func validateMessage(channel string, msgData []byte) error {
+	rule := getChannelRule(channel)
+	if rule == nil {
+		return nil
+	}
+	if rule.MaxSize > 0 && len(msgData) > rule.MaxSize {
+		return fmt.Errorf("%w: %d bytes on channel '%s' (max %d bytes)", ErrMessageTooLarge, len(msgData), channel, rule.MaxSize)
+	}
+	if rule.schema == nil {
+		return nil
+	}
+	result, err := rule.schema.Validate(gojsonschema.NewBytesLoader(msgData))
+	if err != nil {
+		return fmt.Errorf("%w on channel '%s': %s", ErrInvalidMessage, channel, err)
+	}
+	if !result.Valid() {
+		msgs := make([]string, len(result.Errors()))
+		for i, e := range result.Errors() {
+			msgs[i] = e.String()
+		}
+		return fmt.Errorf("%w on channel '%s': %s", ErrInvalidMessage, channel, strings.Join(msgs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package bus
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/hexya-addons/bus/bustypes"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/q"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestChannelRules(t *testing.T) {
+	Convey("Testing channel rules", t, func() {
+		RegisterChannelRule("rules.", ChannelRule{MaxSize: 10})
+		RegisterChannelRule("rules.schema.", ChannelRule{Schema: `{"type": "string"}`})
+		Convey("Longest prefix rule applies", func() {
+			So(getChannelRule("rules.schema.foo").MaxSize, ShouldEqual, 0)
+			So(getChannelRule("rules.foo").MaxSize, ShouldEqual, 10)
+			So(getChannelRule("other").MaxSize, ShouldEqual, defaultMaxMessageSize)
+		})
+		Convey("Messages are checked against their channel rule", func() {
+			So(validateMessage("rules.foo", []byte(`"hello"`)), ShouldBeNil)
+			So(errors.Is(validateMessage("rules.foo", []byte(`"hello world"`)), ErrMessageTooLarge), ShouldBeTrue)
+			So(validateMessage("rules.schema.foo", []byte(`"hello world"`)), ShouldBeNil)
+			So(errors.Is(validateMessage("rules.schema.foo", []byte(`{"hello": "world"}`)), ErrInvalidMessage), ShouldBeTrue)
+		})
+		Convey("Invalid schemas panic on registration", func() {
+			So(func() { RegisterChannelRule("rules.bad.", ChannelRule{Schema: `{"type": 12}`}) }, ShouldPanic)
+		})
+	})
+}
+
+func TestMessageValidation(t *testing.T) {
+	cl := newTestClient()
+	Convey("Testing message validation", t, func() {
+		RegisterChannelRule("restricted.", ChannelRule{
+			MaxSize: 64,
+			Schema:  `{"type": "object", "required": ["title"], "properties": {"title": {"type": "string"}}}`,
+		})
+		Convey("Too large messages are rejected", func() {
+			models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+				err := h.BusBus().NewSet(env).SendoneE("restricted.channel", map[string]interface{}{
+					"title": strings.Repeat("a", 100),
+				})
+				So(errors.Is(err, ErrMessageTooLarge), ShouldBeTrue)
+			})
+		})
+		Convey("Messages not matching the schema are rejected", func() {
+			models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+				err := h.BusBus().NewSet(env).SendoneE("restricted.channel", map[string]interface{}{
+					"name": "Hello",
+				})
+				So(errors.Is(err, ErrInvalidMessage), ShouldBeTrue)
+			})
+		})
+		Convey("Rejected messages sent with Sendone are logged and not stored", func() {
+			models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+				So(func() {
+					h.BusBus().NewSet(env).Sendone("restricted.logged", map[string]interface{}{"name": "Hello"})
+				}, ShouldNotPanic)
+				So(h.BusBus().Search(env, q.BusBus().Channel().Equals("restricted.logged")).IsEmpty(), ShouldBeTrue)
+			})
+		})
+		Convey("Client side sending of invalid message returns an RPC error", func() {
+			_, err := cl.RPC("/longpolling/send", "call", bustypes.Notification{
+				Channel: "restricted.channel",
+				Message: "Hello",
+			})
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Valid messages are sent", func() {
+			models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+				err := h.BusBus().NewSet(env).SendoneE("restricted.channel", map[string]interface{}{
+					"title": "Hello",
+				})
+				So(err, ShouldBeNil)
+			})
+		})
+	})
+}